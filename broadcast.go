@@ -0,0 +1,330 @@
+package apns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	ProductionBroadcastGateway = "api.push.apple.com:443"
+	SandboxBroadcastGateway    = "api.sandbox.push.apple.com:443"
+
+	ProductionChannelGateway = "api-manage-broadcast.push.apple.com:2196"
+	SandboxChannelGateway    = "api-manage-broadcast.sandbox.push.apple.com:2195"
+)
+
+// MaxBroadcastPayloadSize is the largest JSON payload of a broadcast, in
+// bytes
+const MaxBroadcastPayloadSize = 4096
+
+const (
+	// DefaultBroadcastPingInterval is how long a BroadcastClient's connection
+	// can go without a frame from APNs before it's checked with a PING
+	DefaultBroadcastPingInterval = 30 * time.Second
+
+	// DefaultBroadcastPingTimeout is how long the PING can go unanswered
+	// before the connection is closed, and the next request redials
+	DefaultBroadcastPingTimeout = 15 * time.Second
+)
+
+// ErrBroadcastPushType is returned by SendBroadcast for notifications that
+// aren't Live Activity updates
+var ErrBroadcastPushType = errors.New("broadcasts must have the liveactivity push type")
+
+// MessageStoragePolicy is whether APNs keeps a channel's latest broadcast for
+// devices that are offline
+type MessageStoragePolicy int
+
+const (
+	NoMessageStored         MessageStoragePolicy = 0
+	MostRecentMessageStored MessageStoragePolicy = 1
+)
+
+// Channel is a broadcast channel Live Activities subscribe to
+type Channel struct {
+	ID                   string
+	MessageStoragePolicy MessageStoragePolicy
+}
+
+type channelConfig struct {
+	MessageStoragePolicy MessageStoragePolicy `json:"message-storage-policy"`
+	PushType             string               `json:"push-type"`
+}
+
+// BroadcastError is an error response from the broadcast or channel
+// management endpoints
+type BroadcastError struct {
+	StatusCode int
+	Reason     string
+	RequestID  string
+}
+
+func (e *BroadcastError) Error() string {
+	return fmt.Sprintf("APNs responded %d: %s", e.StatusCode, e.Reason)
+}
+
+// BroadcastClient sends broadcast notifications to the Live Activities
+// subscribed to a channel, and manages the channels of an app, over HTTP/2
+type BroadcastClient struct {
+	// Gateway receives broadcasts, ChannelGateway manages channels
+	Gateway        string
+	ChannelGateway string
+
+	// BundleID is the app the channels belong to
+	BundleID string
+
+	// HTTPClient makes the requests. It must authenticate with the app's
+	// certificate, and should use HTTP/2.
+	HTTPClient *http.Client
+
+	// Proxy is an http:// proxy URL to connect through, with optional user
+	// info for authentication. HTTPS_PROXY and NO_PROXY are used when it's
+	// nil. Only the HTTPClient made by NewBroadcastClientWithCert uses it.
+	Proxy *url.URL
+}
+
+// NewBroadcastClientWithCert creates a BroadcastClient for the app bundleID.
+// gw is ProductionBroadcastGateway or SandboxBroadcastGateway, and the
+// matching channel gateway is used. Any other gateway is used for both.
+func NewBroadcastClientWithCert(gw string, bundleID string, cert tls.Certificate) *BroadcastClient {
+	channelGw := gw
+	switch gw {
+	case ProductionBroadcastGateway:
+		channelGw = ProductionChannelGateway
+	case SandboxBroadcastGateway:
+		channelGw = SandboxChannelGateway
+	}
+
+	c := &BroadcastClient{
+		Gateway:        gw,
+		ChannelGateway: channelGw,
+		BundleID:       bundleID,
+	}
+
+	dialer := &net.Dialer{Timeout: DefaultDialTimeout, KeepAlive: DefaultKeepAlive}
+	transport := &http.Transport{
+		Proxy:               c.proxy,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSHandshakeTimeout: DefaultHandshakeTimeout,
+		ForceAttemptHTTP2:   true,
+	}
+
+	// Connections are reused, and PINGed when they go quiet so a dead one
+	// is noticed before a request waits on it. Requests APNs didn't process
+	// before a GOAWAY are retried on a new connection.
+	if h2, err := http2.ConfigureTransports(transport); err == nil {
+		h2.ReadIdleTimeout = DefaultBroadcastPingInterval
+		h2.PingTimeout = DefaultBroadcastPingTimeout
+	}
+	c.HTTPClient = &http.Client{Transport: transport}
+
+	return c
+}
+
+func (c *BroadcastClient) proxy(req *http.Request) (*url.URL, error) {
+	if c.Proxy != nil {
+		return c.Proxy, nil
+	}
+
+	return http.ProxyFromEnvironment(req)
+}
+
+// NewBroadcastClient creates a BroadcastClient from a PEM certificate and key
+func NewBroadcastClient(gw string, bundleID string, cert string, key string) (*BroadcastClient, error) {
+	crt, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBroadcastClientWithCert(gw, bundleID, crt), nil
+}
+
+// do makes a request, and turns error responses into a *BroadcastError. The
+// caller closes the response body.
+func (c *BroadcastClient) do(method string, gw string, path string, header map[string]string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, "https://"+gw+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+
+		var e struct {
+			Reason string `json:"reason"`
+		}
+		json.NewDecoder(res.Body).Decode(&e)
+
+		return nil, &BroadcastError{
+			StatusCode: res.StatusCode,
+			Reason:     e.Reason,
+			RequestID:  res.Header.Get("apns-request-id"),
+		}
+	}
+
+	return res, nil
+}
+
+func (c *BroadcastClient) channelsPath(endpoint string) string {
+	return "/1/apps/" + url.PathEscape(c.BundleID) + "/" + endpoint
+}
+
+// CreateChannel creates a channel for Live Activity broadcasts
+func (c *BroadcastClient) CreateChannel(policy MessageStoragePolicy) (Channel, error) {
+	body, err := json.Marshal(channelConfig{MessageStoragePolicy: policy, PushType: "LiveActivity"})
+	if err != nil {
+		return Channel{}, err
+	}
+
+	res, err := c.do(http.MethodPost, c.ChannelGateway, c.channelsPath("channels"), nil, body)
+	if err != nil {
+		return Channel{}, err
+	}
+	defer res.Body.Close()
+
+	return Channel{ID: res.Header.Get("apns-channel-id"), MessageStoragePolicy: policy}, nil
+}
+
+// Channel returns the channel with the given ID
+func (c *BroadcastClient) Channel(id string) (Channel, error) {
+	h := map[string]string{"apns-channel-id": id}
+
+	res, err := c.do(http.MethodGet, c.ChannelGateway, c.channelsPath("channels"), h, nil)
+	if err != nil {
+		return Channel{}, err
+	}
+	defer res.Body.Close()
+
+	var conf channelConfig
+	if err := json.NewDecoder(res.Body).Decode(&conf); err != nil {
+		return Channel{}, err
+	}
+
+	return Channel{ID: id, MessageStoragePolicy: conf.MessageStoragePolicy}, nil
+}
+
+// Channels returns the IDs of all the app's channels
+func (c *BroadcastClient) Channels() ([]string, error) {
+	res, err := c.do(http.MethodGet, c.ChannelGateway, c.channelsPath("all-channels"), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var all struct {
+		Channels []string `json:"channels"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&all); err != nil {
+		return nil, err
+	}
+
+	return all.Channels, nil
+}
+
+// DeleteChannel deletes the channel with the given ID
+func (c *BroadcastClient) DeleteChannel(id string) error {
+	h := map[string]string{"apns-channel-id": id}
+
+	res, err := c.do(http.MethodDelete, c.ChannelGateway, c.channelsPath("channels"), h, nil)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+// validateBroadcast checks n like Validate, minus the device token, which
+// broadcasts don't have
+func validateBroadcast(n Notification) error {
+	errs := n.headerErrors()
+
+	if n.PushType != PushTypeLiveActivity {
+		errs = append(errs, ErrBroadcastPushType)
+	}
+
+	if n.Priority != 0 && n.Priority != PriorityImmediate && n.Priority != PriorityPowerConserve {
+		errs = append(errs, ErrBadPriority)
+	}
+
+	if n.Expiration != nil && !n.Expiration.After(time.Now()) {
+		errs = append(errs, ErrExpired)
+	}
+
+	if j, err := n.payloadJSON(); err != nil {
+		errs = append(errs, err)
+	} else if len(j) > MaxBroadcastPayloadSize {
+		errs = append(errs, ErrPayloadTooLarge)
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Errs: errs}
+	}
+
+	return nil
+}
+
+// SendBroadcast sends n to every Live Activity subscribed to the channel.
+// DeviceToken and Topic are ignored, and an empty PushType defaults to
+// PushTypeLiveActivity. APNSID is sent as the request ID.
+func (c *BroadcastClient) SendBroadcast(channelID string, n Notification) error {
+	if n.PushType == "" {
+		n.PushType = PushTypeLiveActivity
+	}
+
+	if err := validateBroadcast(n); err != nil {
+		return err
+	}
+
+	h := map[string]string{
+		"apns-channel-id": channelID,
+		"apns-push-type":  string(n.PushType),
+	}
+
+	if n.Priority != 0 {
+		h["apns-priority"] = strconv.Itoa(n.Priority)
+	}
+
+	if n.Expiration != nil {
+		h["apns-expiration"] = strconv.FormatInt(n.Expiration.Unix(), 10)
+	}
+
+	if n.APNSID != "" {
+		h["apns-request-id"] = n.APNSID
+	}
+
+	body, err := n.payloadJSON()
+	if err != nil {
+		return err
+	}
+
+	res, err := c.do(http.MethodPost, c.Gateway, "/4/broadcasts/apps/"+url.PathEscape(c.BundleID), h, body)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
@@ -0,0 +1,323 @@
+package apns_test
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+// fakeBroadcastServer implements the channel management and broadcast
+// endpoints for one app, over HTTP/2
+type fakeBroadcastServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	bundleID string
+	channels map[string]int
+	nextID   int
+
+	// The last broadcast received
+	header http.Header
+	body   []byte
+
+	// Connections accepted
+	conns int32
+}
+
+func newFakeBroadcastServer(bundleID string) *fakeBroadcastServer {
+	f := &fakeBroadcastServer{bundleID: bundleID, channels: map[string]int{}}
+
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(f.serve))
+	f.EnableHTTP2 = true
+	f.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&f.conns, 1)
+		}
+	}
+	f.StartTLS()
+
+	return f
+}
+
+func (f *fakeBroadcastServer) fail(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("apns-request-id", "00000000-0000-4000-8000-000000000000")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"reason": reason})
+}
+
+func (f *fakeBroadcastServer) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.ProtoMajor != 2 {
+		f.fail(w, http.StatusHTTPVersionNotSupported, "BadProtocol")
+		return
+	}
+
+	id := r.Header.Get("apns-channel-id")
+	_, exists := f.channels[id]
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/1/apps/"+f.bundleID+"/channels":
+		var conf struct {
+			Policy   int    `json:"message-storage-policy"`
+			PushType string `json:"push-type"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&conf); err != nil || conf.PushType != "LiveActivity" {
+			f.fail(w, http.StatusBadRequest, "BadPushType")
+			return
+		}
+
+		f.nextID++
+		id = fmt.Sprintf("channel%d==", f.nextID)
+		f.channels[id] = conf.Policy
+
+		w.Header().Set("apns-channel-id", id)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "GET" && r.URL.Path == "/1/apps/"+f.bundleID+"/channels":
+		if !exists {
+			f.fail(w, http.StatusNotFound, "ChannelNotRegistered")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message-storage-policy": f.channels[id],
+			"push-type":              "LiveActivity",
+		})
+	case r.Method == "GET" && r.URL.Path == "/1/apps/"+f.bundleID+"/all-channels":
+		ids := []string{}
+		for id := range f.channels {
+			ids = append(ids, id)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"channels": ids})
+	case r.Method == "DELETE" && r.URL.Path == "/1/apps/"+f.bundleID+"/channels":
+		if !exists {
+			f.fail(w, http.StatusNotFound, "ChannelNotRegistered")
+			return
+		}
+
+		delete(f.channels, id)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && r.URL.Path == "/4/broadcasts/apps/"+f.bundleID:
+		if !exists {
+			f.fail(w, http.StatusBadRequest, "BadChannelId")
+			return
+		}
+
+		f.header = r.Header
+		f.body, _ = ioutil.ReadAll(r.Body)
+
+		w.WriteHeader(http.StatusOK)
+	default:
+		f.fail(w, http.StatusNotFound, "BadPath")
+	}
+}
+
+var _ = Describe("BroadcastClient", func() {
+	var f *fakeBroadcastServer
+	var c *apns.BroadcastClient
+
+	BeforeEach(func() {
+		f = newFakeBroadcastServer("com.example.app")
+
+		cert, _ := tls.X509KeyPair([]byte(DummyCert), []byte(DummyKey))
+		c = apns.NewBroadcastClientWithCert(strings.TrimPrefix(f.URL, "https://"), "com.example.app", cert)
+		c.HTTPClient = f.Client()
+	})
+
+	AfterEach(func() {
+		f.Close()
+	})
+
+	Describe("#NewBroadcastClientWithCert", func() {
+		Context("production gateway", func() {
+			It("should manage channels on the production channel gateway", func() {
+				cert, _ := tls.X509KeyPair([]byte(DummyCert), []byte(DummyKey))
+				c := apns.NewBroadcastClientWithCert(apns.ProductionBroadcastGateway, "com.example.app", cert)
+
+				Expect(c.ChannelGateway).To(Equal(apns.ProductionChannelGateway))
+			})
+		})
+
+		Context("sandbox gateway", func() {
+			It("should manage channels on the sandbox channel gateway", func() {
+				cert, _ := tls.X509KeyPair([]byte(DummyCert), []byte(DummyKey))
+				c := apns.NewBroadcastClientWithCert(apns.SandboxBroadcastGateway, "com.example.app", cert)
+
+				Expect(c.ChannelGateway).To(Equal(apns.SandboxChannelGateway))
+			})
+		})
+	})
+
+	Describe("connections", func() {
+		BeforeEach(func() {
+			cert, _ := tls.X509KeyPair([]byte(DummyCert), []byte(DummyKey))
+			c = apns.NewBroadcastClientWithCert(strings.TrimPrefix(f.URL, "https://"), "com.example.app", cert)
+
+			// Trust the fake server
+			t := c.HTTPClient.Transport.(*http.Transport)
+			t.TLSClientConfig.RootCAs = f.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		})
+
+		It("should reuse one HTTP/2 connection", func() {
+			for i := 0; i < 3; i++ {
+				_, err := c.CreateChannel(apns.NoMessageStored)
+				Expect(err).To(BeNil())
+			}
+
+			Expect(atomic.LoadInt32(&f.conns)).To(Equal(int32(1)))
+		})
+
+		Context("closed by APNs with a GOAWAY", func() {
+			It("should redial", func() {
+				// The server sends a GOAWAY after every response
+				f.Config.SetKeepAlivesEnabled(false)
+
+				for i := 0; i < 3; i++ {
+					_, err := c.CreateChannel(apns.NoMessageStored)
+					Expect(err).To(BeNil())
+				}
+
+				Expect(atomic.LoadInt32(&f.conns)).To(Equal(int32(3)))
+			})
+		})
+	})
+
+	Describe("#Proxy", func() {
+		It("should tunnel requests through it", func() {
+			p := newFakeProxy(httpConnect)
+			defer p.l.Close()
+
+			cert, _ := tls.X509KeyPair([]byte(DummyCert), []byte(DummyKey))
+			c := apns.NewBroadcastClientWithCert(strings.TrimPrefix(f.URL, "https://"), "com.example.app", cert)
+			c.Proxy = p.url("http", url.UserPassword("user", "secret"))
+
+			// Trust the fake server
+			t := c.HTTPClient.Transport.(*http.Transport)
+			t.TLSClientConfig.RootCAs = f.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+			_, err := c.CreateChannel(apns.NoMessageStored)
+			Expect(err).To(BeNil())
+			Expect(<-p.targets).To(Equal(strings.TrimPrefix(f.URL, "https://")))
+		})
+	})
+
+	Describe("channels", func() {
+		It("should create, read, list and delete them", func() {
+			ch, err := c.CreateChannel(apns.MostRecentMessageStored)
+			Expect(err).To(BeNil())
+			Expect(ch.ID).NotTo(BeEmpty())
+
+			read, err := c.Channel(ch.ID)
+			Expect(err).To(BeNil())
+			Expect(read).To(Equal(ch))
+
+			ids, err := c.Channels()
+			Expect(err).To(BeNil())
+			Expect(ids).To(ConsistOf(ch.ID))
+
+			Expect(c.DeleteChannel(ch.ID)).To(BeNil())
+
+			ids, err = c.Channels()
+			Expect(err).To(BeNil())
+			Expect(ids).To(BeEmpty())
+		})
+
+		Context("unknown channel", func() {
+			It("should return the reason", func() {
+				_, err := c.Channel("nope")
+
+				Expect(err).To(Equal(&apns.BroadcastError{
+					StatusCode: http.StatusNotFound,
+					Reason:     "ChannelNotRegistered",
+					RequestID:  "00000000-0000-4000-8000-000000000000",
+				}))
+			})
+		})
+	})
+
+	Describe("#SendBroadcast", func() {
+		var ch apns.Channel
+
+		BeforeEach(func() {
+			ch, _ = c.CreateChannel(apns.NoMessageStored)
+		})
+
+		It("should send the notification to the channel", func() {
+			exp := time.Now().Add(time.Hour)
+
+			p := apns.NewPayload()
+			p.SetCustomValue("content-state", map[string]int{"score": 3})
+
+			n := apns.Notification{
+				Payload:    p,
+				Priority:   apns.PriorityImmediate,
+				Expiration: &exp,
+				APNSID:     "123e4567-e89b-42d3-a456-426614174000",
+			}
+
+			Expect(c.SendBroadcast(ch.ID, n)).To(BeNil())
+
+			Expect(f.header.Get("apns-channel-id")).To(Equal(ch.ID))
+			Expect(f.header.Get("apns-push-type")).To(Equal("liveactivity"))
+			Expect(f.header.Get("apns-priority")).To(Equal("10"))
+			Expect(f.header.Get("apns-expiration")).To(Equal(fmt.Sprint(exp.Unix())))
+			Expect(f.header.Get("apns-request-id")).To(Equal(n.APNSID))
+			Expect(string(f.body)).To(Equal(`{"aps":{},"content-state":{"score":3}}`))
+		})
+
+		Context("unknown channel", func() {
+			It("should return the reason", func() {
+				err := c.SendBroadcast("nope", apns.Notification{Payload: apns.NewPayload()})
+
+				Expect(err).To(BeAssignableToTypeOf(&apns.BroadcastError{}))
+				Expect(err.(*apns.BroadcastError).Reason).To(Equal("BadChannelId"))
+			})
+		})
+
+		Context("another push type", func() {
+			It("should be rejected", func() {
+				n := apns.Notification{Payload: apns.NewPayload(), PushType: apns.PushTypeAlert}
+
+				err := c.SendBroadcast(ch.ID, n)
+
+				Expect(err).To(MatchError(apns.ErrBroadcastPushType))
+				Expect(f.body).To(BeNil())
+			})
+		})
+
+		Context("payload over 4KB", func() {
+			It("should be rejected", func() {
+				p := apns.NewPayload()
+				p.APS.Alert.Body = strings.Repeat("x", apns.MaxBroadcastPayloadSize)
+
+				err := c.SendBroadcast(ch.ID, apns.Notification{Payload: p})
+
+				Expect(err).To(MatchError(apns.ErrPayloadTooLarge))
+			})
+		})
+
+		Context("payload over 2KB", func() {
+			It("should be sent", func() {
+				p := apns.NewPayload()
+				p.APS.Alert.Body = strings.Repeat("x", 3000)
+
+				Expect(c.SendBroadcast(ch.ID, apns.Notification{Payload: p})).To(BeNil())
+			})
+		})
+	})
+})
@@ -0,0 +1,159 @@
+package apns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// Subject attribute Apple stores the bundle ID in
+	oidUserID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+	// Apple's custom push certificate extensions
+	oidSandbox    = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 1}
+	oidProduction = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 2}
+	oidTopics     = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 6}
+)
+
+// CertInfo describes what an APNs push certificate can be used for
+type CertInfo struct {
+	NotAfter time.Time
+	BundleID string
+
+	// Topics the certificate may push to, e.g. the bundle ID and its
+	// ".voip" and ".complication" variants
+	Topics []string
+
+	// Environments the certificate is valid for. Universal certificates
+	// are valid for both.
+	Sandbox    bool
+	Production bool
+}
+
+// NewCertInfo parses the leaf of a push certificate, such as the one passed
+// to NewConnWithCert
+func NewCertInfo(cert tls.Certificate) (CertInfo, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return CertInfo{}, errors.New("no certificate found")
+		}
+
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return CertInfo{}, err
+		}
+	}
+
+	ci := CertInfo{NotAfter: leaf.NotAfter}
+
+	for _, name := range leaf.Subject.Names {
+		if uid, ok := name.Value.(string); ok && name.Type.Equal(oidUserID) {
+			ci.BundleID = uid
+		}
+	}
+
+	// Older certificates only carry the bundle ID in the common name, e.g.
+	// "Apple Production IOS Push Services: com.example.app"
+	cn := leaf.Subject.CommonName
+	if i := strings.LastIndex(cn, ": "); ci.BundleID == "" && i >= 0 {
+		ci.BundleID = cn[i+2:]
+	}
+
+	var hasEnvExt bool
+	for _, ext := range leaf.Extensions {
+		switch {
+		case ext.Id.Equal(oidSandbox):
+			ci.Sandbox, hasEnvExt = true, true
+		case ext.Id.Equal(oidProduction):
+			ci.Production, hasEnvExt = true, true
+		case ext.Id.Equal(oidTopics):
+			topics, err := parseTopics(ext.Value)
+			if err != nil {
+				return CertInfo{}, err
+			}
+			ci.Topics = topics
+		}
+	}
+
+	if !hasEnvExt {
+		ci.Sandbox = strings.HasPrefix(cn, "Apple Development")
+		ci.Production = strings.HasPrefix(cn, "Apple Production")
+	}
+
+	if ci.Topics == nil && ci.BundleID != "" {
+		ci.Topics = []string{ci.BundleID}
+	}
+
+	return ci, nil
+}
+
+// parseTopics reads the topics extension, a sequence of topic strings each
+// followed by a sequence describing the topic type
+func parseTopics(der []byte) ([]string, error) {
+	var seq asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &seq); err != nil {
+		return nil, fmt.Errorf("invalid topics extension: %s", err)
+	}
+
+	topics := []string{}
+	for rest := seq.Bytes; len(rest) > 0; {
+		var v asn1.RawValue
+
+		var err error
+		rest, err = asn1.Unmarshal(rest, &v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid topics extension: %s", err)
+		}
+
+		if v.Class == asn1.ClassUniversal && v.Tag == asn1.TagUTF8String {
+			topics = append(topics, string(v.Bytes))
+		}
+	}
+
+	return topics, nil
+}
+
+// ExpiresWithin reports whether the certificate will have expired d from now
+func (ci CertInfo) ExpiresWithin(d time.Duration) bool {
+	return time.Now().Add(d).After(ci.NotAfter)
+}
+
+// HasTopic reports whether the certificate may push to topic
+func (ci CertInfo) HasTopic(topic string) bool {
+	for _, t := range ci.Topics {
+		if t == topic {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckGateway returns an error if the certificate has expired or is for the
+// wrong environment of one of Apple's gateways. Only expiry is checked for
+// other gateways.
+func (ci CertInfo) CheckGateway(gw string) error {
+	switch gw {
+	case SandboxGateway, SandboxFeedbackGateway:
+		if !ci.Sandbox && ci.Production {
+			return fmt.Errorf("certificate is not valid for sandbox gateway %s", gw)
+		}
+	case ProductionGateway, ProductionFeedbackGateway:
+		if !ci.Production && ci.Sandbox {
+			return fmt.Errorf("certificate is not valid for production gateway %s", gw)
+		}
+	}
+
+	if ci.ExpiresWithin(0) {
+		return fmt.Errorf("certificate expired on %s", ci.NotAfter)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package apns_test
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+// pushCert creates a certificate shaped like the ones issued by Apple
+func pushCert(notAfter time.Time, exts ...pkix.Extension) tls.Certificate {
+	dummy, _ := tls.X509KeyPair([]byte(DummyCert), []byte(DummyKey))
+	leaf, _ := x509.ParseCertificate(dummy.Certificate[0])
+
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "Apple Push Services: com.example.app",
+			ExtraNames: []pkix.AttributeTypeAndValue{
+				{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}, Value: "com.example.app"},
+			},
+		},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        notAfter,
+		ExtraExtensions: exts,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, leaf.PublicKey, dummy.PrivateKey)
+	if err != nil {
+		panic(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: dummy.PrivateKey}
+}
+
+var (
+	sandboxExt    = pkix.Extension{Id: asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 1}, Value: []byte{0x05, 0x00}}
+	productionExt = pkix.Extension{Id: asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 2}, Value: []byte{0x05, 0x00}}
+)
+
+func topicsExt(topics ...string) pkix.Extension {
+	var body []byte
+	for _, t := range topics {
+		topic, _ := asn1.MarshalWithParams(t, "utf8")
+		kind, _ := asn1.MarshalWithParams([]string{"app"}, "utf8")
+
+		body = append(body, topic...)
+		body = append(body, kind...)
+	}
+
+	b, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: body})
+
+	return pkix.Extension{Id: asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 6}, Value: b}
+}
+
+var _ = Describe("CertInfo", func() {
+	Describe(".NewCertInfo", func() {
+		Context("no certificate", func() {
+			It("should return an error", func() {
+				_, err := apns.NewCertInfo(tls.Certificate{})
+				Expect(err).NotTo(BeNil())
+			})
+		})
+
+		Context("universal certificate", func() {
+			notAfter := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second).UTC()
+			cert := pushCert(notAfter, sandboxExt, productionExt, topicsExt("com.example.app", "com.example.app.voip"))
+
+			It("should read the expiry, bundle ID and topics", func() {
+				ci, err := apns.NewCertInfo(cert)
+				Expect(err).To(BeNil())
+
+				Expect(ci.NotAfter).To(Equal(notAfter))
+				Expect(ci.BundleID).To(Equal("com.example.app"))
+				Expect(ci.Topics).To(Equal([]string{"com.example.app", "com.example.app.voip"}))
+				Expect(ci.HasTopic("com.example.app.voip")).To(BeTrue())
+				Expect(ci.HasTopic("com.example.other")).To(BeFalse())
+			})
+
+			It("should be valid for both environments", func() {
+				ci, _ := apns.NewCertInfo(cert)
+
+				Expect(ci.Sandbox).To(BeTrue())
+				Expect(ci.Production).To(BeTrue())
+				Expect(ci.CheckGateway(apns.SandboxGateway)).To(BeNil())
+				Expect(ci.CheckGateway(apns.ProductionGateway)).To(BeNil())
+			})
+		})
+
+		Context("sandbox only certificate", func() {
+			cert := pushCert(time.Now().Add(time.Hour), sandboxExt)
+
+			It("should refuse the production gateways", func() {
+				ci, _ := apns.NewCertInfo(cert)
+
+				Expect(ci.Topics).To(Equal([]string{"com.example.app"}))
+				Expect(ci.CheckGateway(apns.SandboxGateway)).To(BeNil())
+				Expect(ci.CheckGateway(apns.ProductionGateway)).NotTo(BeNil())
+				Expect(ci.CheckGateway(apns.ProductionFeedbackGateway)).NotTo(BeNil())
+			})
+		})
+
+		Context("certificate without Apple extensions", func() {
+			It("should not know the environment", func() {
+				cert, _ := tls.X509KeyPair([]byte(DummyCert), []byte(DummyKey))
+				ci, err := apns.NewCertInfo(cert)
+				Expect(err).To(BeNil())
+
+				Expect(ci.BundleID).To(Equal(""))
+				Expect(ci.Sandbox).To(BeFalse())
+				Expect(ci.Production).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("#ExpiresWithin", func() {
+		cert := pushCert(time.Now().Add(10*24*time.Hour), productionExt)
+
+		It("should warn ahead of expiry", func() {
+			ci, _ := apns.NewCertInfo(cert)
+
+			Expect(ci.ExpiresWithin(24 * time.Hour)).To(BeFalse())
+			Expect(ci.ExpiresWithin(30 * 24 * time.Hour)).To(BeTrue())
+		})
+	})
+
+	Describe("#CheckGateway", func() {
+		Context("expired certificate", func() {
+			It("should return an error", func() {
+				cert, _ := tls.X509KeyPair([]byte(DummyCert), []byte(DummyKey))
+				ci, _ := apns.NewCertInfo(cert)
+
+				Expect(ci.CheckGateway(apns.ProductionGateway)).NotTo(BeNil())
+			})
+		})
+	})
+})
@@ -5,97 +5,550 @@ import (
 	"crypto/tls"
 	"io"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultFailedNotifsSize is how many failures FailedNotifs holds for a slow
+// receiver
+const DefaultFailedNotifsSize = 100
+
+// DefaultOutboxSettleTime is the SettleTime UseOutbox sets when neither
+// SettleTime nor SettleCount is
+const DefaultOutboxSettleTime = 5 * time.Second
+
+// ResetThrottleInterval is how close together two connections the gateway
+// dropped without an error response have to be to throttle the RateLimiter
+const ResetThrottleInterval = 30 * time.Second
+
+// OverflowPolicy decides what happens to failures when FailedNotifs is full
+type OverflowPolicy int
+
+const (
+	// OverflowDrop drops the new failure
+	OverflowDrop OverflowPolicy = iota
+
+	// OverflowDropOldest drops the oldest failure in FailedNotifs to make
+	// room for the new one. An unbuffered FailedNotifs has no room to
+	// make, so OverflowDrop is used instead.
+	OverflowDropOldest
+
+	// OverflowBlock waits for room, which holds up sending
+	OverflowBlock
+)
+
 type buffer struct {
 	size int
 	*list.List
+
+	// evict is called with values pushed out of the buffer by Add
+	evict func(v interface{})
 }
 
 func newBuffer(size int) *buffer {
-	return &buffer{size, list.New()}
+	return &buffer{size: size, List: list.New()}
 }
 
 func (b *buffer) Add(v interface{}) *list.Element {
 	e := b.PushBack(v)
 
 	if b.Len() > b.size {
-		b.Remove(b.Front())
+		evicted := b.Remove(b.Front())
+
+		if b.evict != nil {
+			b.evict(evicted)
+		}
 	}
 
 	return e
 }
 
+// idAllocator hands out the identifiers notifications are written with. They
+// are unique among the notifications in the resend buffer, so an error
+// response always matches the right one, and skip 0 when they wrap around.
+type idAllocator struct {
+	next  uint32
+	inUse map[uint32]bool
+}
+
+func newIDAllocator() *idAllocator {
+	return &idAllocator{next: 1, inUse: map[uint32]bool{}}
+}
+
+// get returns preferred if it's free, or the next free identifier
+func (a *idAllocator) get(preferred uint32) uint32 {
+	if preferred != 0 && !a.inUse[preferred] {
+		a.inUse[preferred] = true
+		return preferred
+	}
+
+	for a.next == 0 || a.inUse[a.next] {
+		a.next++
+	}
+
+	id := a.next
+	a.next++
+	a.inUse[id] = true
+
+	return id
+}
+
+func (a *idAllocator) release(id uint32) {
+	delete(a.inUse, id)
+}
+
+// ResultHandler is told what became of the notifications a Client accepted
+type ResultHandler interface {
+	// OnSuccess is called with notifications that went without an error
+	// response from APNs long enough to be considered delivered
+	OnSuccess(n Notification)
+
+	// OnFailure is called with notifications APNs rejected
+	OnFailure(n Notification, err error)
+
+	// OnDropped is called with notifications the client gave up on without
+	// sending them, e.g. deferred ones that expired, or that Send rejected
+	// when their time came
+	OnDropped(n Notification, err error)
+}
+
+// Client sends notifications to APNs from a goroutine started by the first
+// Send. It's always used through the pointer the NewClient functions return,
+// so that goroutine sees the settings made on it.
 type Client struct {
-	Conn         *Conn
-	FailedNotifs chan NotificationResult
+	Conn *Conn
+
+	// FailedNotifs receives the notifications APNs rejected. It's buffered
+	// with DefaultFailedNotifsSize, and can be replaced with a channel of
+	// another size before the first Send. FailureOverflow decides what
+	// happens when it's full, and FailuresLost counts the failures dropped.
+	FailedNotifs    chan NotificationResult
+	FailureOverflow OverflowPolicy
+
+	// TokenStore is optional. When set, notifications to invalidated tokens
+	// are rejected by Send, tokens APNs reports as invalid are invalidated,
+	// and notifications that made it out of the resend buffer without an
+	// error are recorded as successes. Successes are recorded from another
+	// goroutine, in batches. Set it before the first Send.
+	TokenStore TokenStore
+
+	// Outbox is optional, see UseOutbox
+	Outbox Outbox
+
+	// RateLimiter is optional. It's throttled when the gateway drops the
+	// connection without an error response twice within
+	// ResetThrottleInterval. Set it before the first Send.
+	RateLimiter *RateLimiter
+
+	// Dedupe is optional. Notifications it has seen are rejected by Send
+	// with ErrDuplicate, before the RateLimiter. Ones Send rejects for
+	// another reason are forgotten, so they can be retried. Resends after
+	// an error response aren't affected. Set it before the first Send.
+	Dedupe *Deduplicator
+
+	// ResultHandler is optional. It's called from the goroutine writing to
+	// APNs, so it should return quickly. Set it before the first Send.
+	ResultHandler ResultHandler
+
+	// Notifications are confirmed as delivered once they've gone SettleTime,
+	// or SettleCount later notifications, without an error response from
+	// APNs. Otherwise they're only confirmed when they're pushed out of the
+	// resend buffer, which holds 50. A notification confirmed early stays in
+	// the buffer, and an error for it is still reported as a failure. Set
+	// them before the first Send.
+	SettleTime  time.Duration
+	SettleCount int
+
+	// SentinelInterval makes the client write a notification to an invalid
+	// token that often while notifications are waiting to be confirmed.
+	// APNs rejects it, which confirms every notification written before it,
+	// and closes the connection. Set it before the first Send.
+	SentinelInterval time.Duration
+
+	// WriteBufferSize batches notifications into writes of up to this many
+	// bytes, which are flushed after FlushInterval (DefaultFlushInterval
+	// when 0) at the latest. Notifications are written one by one when it's
+	// 0. Set them before the first Send.
+	WriteBufferSize int
+	FlushInterval   time.Duration
+
+	// VoIP marks a client connected with a VoIP certificate. Send only
+	// accepts notifications with PushTypeVoIP on it, e.g. from
+	// NewVoIPNotification, and rejects them on other clients. Set it before
+	// the first Send.
+	VoIP bool
+
+	// Filters run on every notification passed to Send, in order, after
+	// the VoIP, TokenStore and Dedupe checks. Deferred notifications are
+	// held by an internal Scheduler, and kept in the Outbox, and are checked
+	// and filtered again when their time comes. They wait for the
+	// RateLimiter then, even without Block. Set them before the first Send.
+	Filters []SendFilter
 
 	notifs chan Notification
-	id     uint32
+	ids    *idAllocator
+
+	// The connection is made on the first Send, so it sees the settings
+	// made after the client was created
+	start sync.Once
+
+	successes *successRecorder
+
+	deferred     *Scheduler
+	deferredOnce sync.Once
+
+	failuresLost atomic.Uint64
+
+	lastSentinel time.Time
+	lastReset    time.Time
 }
 
-func newClientWithConn(gw string, conn Conn) Client {
-	c := Client{
+func newClientWithConn(gw string, conn Conn) *Client {
+	c := &Client{
 		Conn:         &conn,
-		FailedNotifs: make(chan NotificationResult),
-		id:           uint32(1),
+		FailedNotifs: make(chan NotificationResult, DefaultFailedNotifsSize),
+		ids:          newIDAllocator(),
 		notifs:       make(chan Notification),
 	}
 
-	go c.runLoop()
-
 	return c
 }
 
-func NewClientWithCert(gw string, cert tls.Certificate) Client {
+func NewClientWithCert(gw string, cert tls.Certificate) *Client {
 	conn := NewConnWithCert(gw, cert)
 
 	return newClientWithConn(gw, conn)
 }
 
-func NewClient(gw string, cert string, key string) (Client, error) {
+func NewClient(gw string, cert string, key string) (*Client, error) {
 	conn, err := NewConn(gw, cert, key)
 	if err != nil {
-		return Client{}, err
+		return nil, err
 	}
 
 	return newClientWithConn(gw, conn), nil
 }
 
-func NewClientWithFiles(gw string, certFile string, keyFile string) (Client, error) {
+func NewClientWithFiles(gw string, certFile string, keyFile string) (*Client, error) {
 	conn, err := NewConnWithFiles(gw, certFile, keyFile)
 	if err != nil {
-		return Client{}, err
+		return nil, err
+	}
+
+	return newClientWithConn(gw, conn), nil
+}
+
+// NewClientWithP12 creates a new Client from the PKCS#12 (.p12) bundle in the
+// specified file
+func NewClientWithP12(gw string, p12File string, password string) (*Client, error) {
+	conn, err := NewConnWithP12File(gw, p12File, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClientWithConn(gw, conn), nil
+}
+
+// NewClientWithP12Bytes creates a new Client from a PKCS#12 (.p12) bundle
+func NewClientWithP12Bytes(gw string, p12 []byte, password string) (*Client, error) {
+	conn, err := NewConnWithP12(gw, p12, password)
+	if err != nil {
+		return nil, err
 	}
 
 	return newClientWithConn(gw, conn), nil
 }
 
 func (c *Client) Send(n Notification) error {
+	return c.send(n, false)
+}
+
+// send checks n and queues it, or schedules it if a filter defers it.
+// Deferred notifications come back through it when their time comes, and
+// notifications replayed from the Outbox go through it too. Those are sent
+// in the background, and wait for the RateLimiter rather than fail, as
+// there can be many of them at once.
+func (c *Client) send(n Notification, background bool) error {
+	if err := n.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.voipError(n); err != nil {
+		return err
+	}
+
+	if c.TokenStore != nil {
+		valid, err := c.TokenStore.TokenValid(n.DeviceToken)
+		if err != nil {
+			return err
+		}
+
+		if !valid {
+			return ErrTokenInvalidated
+		}
+	}
+
+	// Before the RateLimiter, so duplicates don't use up its budget.
+	// Deferred notifications were seen before they were deferred.
+	seen := !n.deferred && c.Dedupe != nil
+	if seen && c.Dedupe.Seen(n) {
+		return ErrDuplicate
+	}
+
+	if err := c.accept(n, background); err != nil {
+		// It wasn't sent, so the caller can retry it
+		if seen {
+			c.Dedupe.forget(n)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// accept runs the filters on n, and then queues it or schedules it
+func (c *Client) accept(n Notification, background bool) error {
+	if deferred, err := c.filter(&n); deferred || err != nil {
+		return err
+	}
+
+	// Again, as the filters may have lowered the priority
+	if err := c.voipError(n); err != nil {
+		return err
+	}
+
+	if c.RateLimiter != nil {
+		if c.RateLimiter.Block || background {
+			c.RateLimiter.Wait(n.DeviceToken)
+		} else if !c.RateLimiter.Allow(n.DeviceToken) {
+			return ErrRateLimited
+		}
+	}
+
+	// Deferred notifications were added before they were scheduled
+	if c.Outbox != nil && n.outboxID == 0 {
+		id, err := c.Outbox.Add(n)
+		if err != nil {
+			return err
+		}
+		n.outboxID = id
+	}
+
+	c.queue(n)
+	return nil
+}
+
+// filter runs the filters on n, and schedules it if one defers it. It
+// reports whether n was deferred.
+func (c *Client) filter(n *Notification) (bool, error) {
+	now := time.Now()
+	for _, f := range c.Filters {
+		at, err := f.FilterSend(n, now)
+		if err != nil {
+			return false, err
+		}
+
+		if at.After(now) {
+			return true, c.deferUntil(*n, at)
+		}
+	}
+
+	return false, nil
+}
+
+// deferUntil schedules n, after adding it to the Outbox so it isn't lost if
+// the process stops before then
+func (c *Client) deferUntil(n Notification, at time.Time) error {
+	c.deferredOnce.Do(func() {
+		c.deferred = NewScheduler(c)
+		c.deferred.deliver = func(n Notification) error { return c.send(n, true) }
+		c.deferred.OnExpired = func(n Notification) { c.dropped(n, ErrExpired) }
+		c.deferred.OnSendError = c.dropped
+	})
+
+	n.deferred = true
+
+	added := false
+	if c.Outbox != nil && n.outboxID == 0 {
+		id, err := c.Outbox.Add(n)
+		if err != nil {
+			return err
+		}
+		n.outboxID = id
+		added = true
+	}
+
+	if err := c.deferred.Schedule(n, at); err != nil {
+		if added {
+			c.finish(n, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// queue hands n to the goroutine writing to APNs, starting it the first time
+func (c *Client) queue(n Notification) {
+	c.start.Do(func() {
+		if c.TokenStore != nil {
+			c.successes = newSuccessRecorder(c.TokenStore)
+		}
+		go c.runLoop()
+	})
+
 	c.notifs <- n
+}
+
+// UseOutbox makes the client persist notifications in o until they're sent
+// or rejected, including deferred ones, and sends the notifications a
+// previous client left pending. Those are checked and filtered like Send
+// does, wait for the RateLimiter, and are reported to OnDropped when
+// they're rejected. They're queued in the background, so it doesn't wait
+// for the gateway.
+//
+// Notifications are only marked sent once they're confirmed, so without
+// SettleTime or SettleCount it's set to DefaultOutboxSettleTime. Otherwise
+// a restart would resend the last 50 notifications, still in the resend
+// buffer. Call it before the first Send, and after the other settings.
+func (c *Client) UseOutbox(o Outbox) error {
+	pending, err := o.Pending()
+	if err != nil {
+		return err
+	}
+
+	c.Outbox = o
+
+	if c.SettleTime == 0 && c.SettleCount == 0 {
+		c.SettleTime = DefaultOutboxSettleTime
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	go func() {
+		for _, e := range pending {
+			n := e.Notif
+			n.outboxID = e.ID
+
+			if err := c.send(n, true); err != nil {
+				c.dropped(n, err)
+			}
+		}
+	}()
+
 	return nil
 }
 
+// succeeded is called with notifications that were pushed out of the resend
+// buffer without APNs reporting an error for them
+func (c *Client) succeeded(v interface{}) {
+	n, ok := v.(Notification)
+	if !ok || n.sentinel || n.settled {
+		return
+	}
+
+	if c.successes != nil {
+		c.successes.record(n.DeviceToken, time.Now())
+	}
+
+	if c.Outbox != nil && n.outboxID != 0 {
+		if err := c.Outbox.Sent(n.outboxID); err != nil {
+			log.Println("err updating apns outbox", err.Error())
+		}
+	}
+
+	if c.ResultHandler != nil {
+		c.ResultHandler.OnSuccess(n)
+	}
+}
+
+// failed is called with notifications APNs rejected
+func (c *Client) failed(n Notification, err error) {
+	c.finish(n, err)
+
+	if c.ResultHandler != nil {
+		c.ResultHandler.OnFailure(n, err)
+	}
+}
+
+// dropped is called with notifications that will never be sent
+func (c *Client) dropped(n Notification, err error) {
+	c.finish(n, err)
+
+	if c.ResultHandler != nil {
+		c.ResultHandler.OnDropped(n, err)
+	}
+}
+
+func (c *Client) finish(n Notification, err error) {
+	if c.Outbox != nil && n.outboxID != 0 {
+		if oerr := c.Outbox.Failed(n.outboxID, err); oerr != nil {
+			log.Println("err updating apns outbox", oerr.Error())
+		}
+	}
+}
+
 func (c *Client) reportFailedPush(v interface{}, err *Error) {
 	failedNotif, ok := v.(Notification)
 	if !ok || v == nil {
 		return
 	}
 
-	select {
-	case c.FailedNotifs <- NotificationResult{Notif: failedNotif, Err: *err}:
+	r := NotificationResult{Notif: failedNotif, Err: *err}
+
+	switch {
+	case c.FailureOverflow == OverflowBlock:
+		c.FailedNotifs <- r
+	case c.FailureOverflow == OverflowDropOldest && cap(c.FailedNotifs) > 0:
+		for {
+			select {
+			case c.FailedNotifs <- r:
+				return
+			default:
+			}
+
+			select {
+			case <-c.FailedNotifs:
+				c.failuresLost.Add(1)
+			default:
+			}
+		}
 	default:
+		select {
+		case c.FailedNotifs <- r:
+		default:
+			c.failuresLost.Add(1)
+		}
 	}
 }
 
-func (c *Client) requeue(cursor *list.Element) {
+// FailuresLost returns the number of failures dropped because FailedNotifs
+// was full
+func (c *Client) FailuresLost() uint64 {
+	return c.failuresLost.Load()
+}
+
+func (c *Client) requeue(cursor *list.Element, buffer *buffer) {
 	// If `cursor` is not nil, this means there are notifications that
-	// need to be delivered (or redelivered)
-	for ; cursor != nil; cursor = cursor.Next() {
-		if n, ok := cursor.Value.(Notification); ok {
-			go func() { c.notifs <- n }()
+	// need to be delivered (or redelivered). They're taken out of the
+	// buffer, and get a new identifier when they're written again.
+	for cursor != nil {
+		next := cursor.Next()
+
+		if n, ok := buffer.Remove(cursor).(Notification); ok {
+			c.ids.release(n.wireID)
+
+			// Settled ones are resent too, as APNs discarded them, but
+			// aren't confirmed again
+			if !n.sentinel {
+				go func() { c.notifs <- n }()
+			}
 		}
+
+		cursor = next
 	}
 }
 
@@ -107,25 +560,66 @@ func (c *Client) handleError(err *Error, buffer *buffer) *list.Element {
 		n, _ := cursor.Value.(Notification)
 
 		// If the notification, move cursor after the trouble notification
-		if n.Identifier == err.Identifier {
-			go c.reportFailedPush(cursor.Value, err)
+		if n.wireID == err.Identifier && n.sentinel {
+			// APNs handles notifications in order, so the ones
+			// written before the sentinel were accepted
+			for e := buffer.Front(); e != cursor; e = buffer.Front() {
+				buffer.evict(buffer.Remove(e))
+			}
 
 			next := cursor.Next()
 
 			buffer.Remove(cursor)
+			c.ids.release(n.wireID)
+			return next
+		}
+
+		if n.wireID == err.Identifier {
+			if err.ErrStr == ErrInvalidToken && c.TokenStore != nil {
+				if ierr := c.TokenStore.InvalidateToken(n.DeviceToken, time.Now()); ierr != nil {
+					log.Println("err invalidating apns token", ierr.Error())
+				}
+			}
+
+			c.failed(n, err)
+			c.reportFailedPush(cursor.Value, err)
+
+			next := cursor.Next()
+
+			buffer.Remove(cursor)
+			c.ids.release(n.wireID)
 			return next
 		}
 
 		cursor = cursor.Prev()
 	}
 
+	// The error matches nothing in the buffer, so it's unknown which
+	// notifications APNs discarded. Resend the ones not yet confirmed
+	// rather than confirm them.
+	for cursor = buffer.Front(); cursor != nil; cursor = cursor.Next() {
+		if n, _ := cursor.Value.(Notification); !n.settled {
+			break
+		}
+	}
+
 	return cursor
 }
 
 func (c *Client) runLoop() {
 	sent := newBuffer(50)
+	sent.evict = func(v interface{}) {
+		if n, ok := v.(Notification); ok {
+			c.ids.release(n.wireID)
+		}
+
+		c.succeeded(v)
+	}
 	cursor := sent.Front()
 
+	// Frames are encoded into the same buffer, which writes don't hold on to
+	var frame []byte
+
 	// APNS connection
 	for {
 		err := c.Conn.Connect()
@@ -138,9 +632,19 @@ func (c *Client) runLoop() {
 		// Start reading errors from APNS
 		errs := readErrs(c.Conn)
 
-		c.requeue(cursor)
+		c.requeue(cursor, sent)
+
+		var ticker *time.Ticker
+		var tick <-chan time.Time
+		if d := c.settleTick(); d > 0 {
+			ticker = time.NewTicker(d)
+			tick = ticker.C
+		}
+
+		fw := c.newFrameWriter()
 
 		// Connection open, listen for notifs and errors
+		reset := false
 		for {
 			var err error
 			var n Notification
@@ -153,6 +657,20 @@ func (c *Client) runLoop() {
 			select {
 			case err = <-errs:
 			case n = <-c.notifs:
+			case now := <-tick:
+				c.settle(sent, now, fw.unflushed)
+				if !c.sentinelDue(sent, now) {
+					continue
+				}
+
+				n = c.newSentinel(now)
+			case <-fw.flushC():
+				fw.armed = false
+				if err = fw.flush(); err == nil {
+					continue
+				}
+
+				log.Println("err writing to apns", err.Error())
 			}
 
 			// If there is an error we understand, find the notification that failed,
@@ -163,41 +681,80 @@ func (c *Client) runLoop() {
 			}
 
 			if err != nil {
+				reset = true
 				break
 			}
 
-			// Add to list
-			cursor = sent.Add(n)
+			// Write the caller's identifier, unless it's unset or still
+			// in use. The notification keeps the caller's either way.
+			n.wireID = c.ids.get(n.Identifier)
 
-			// Set identifier if not specified
-			if n.Identifier == 0 {
-				n.Identifier = c.id
-				c.id++
-			} else if c.id < n.Identifier {
-				c.id = n.Identifier + 1
-			}
+			w := n
+			w.Identifier = n.wireID
 
-			b, err := n.ToBinary()
+			frame, err = w.AppendBinary(frame[:0])
 			if err != nil {
-				// TODO
+				// Send validates notifications, so this is only a
+				// safety net
+				c.ids.release(n.wireID)
+				c.dropped(n, err)
 				continue
 			}
 
-			_, err = c.Conn.Write(b)
+			// Add to list
+			n.sentAt = time.Now()
+			cursor = sent.Add(n)
 
-			if err == io.EOF {
-				log.Println("EOF trying to write notification")
-				break
-			}
+			// Sentinels are flushed right away, so they can't hold up
+			// the notifications they confirm
+			err = fw.write(cursor, frame, n.sentinel)
 
 			if err != nil {
-				log.Println("err writing to apns", err.Error())
+				if err == io.EOF {
+					log.Println("EOF trying to write notification")
+				} else {
+					log.Println("err writing to apns", err.Error())
+				}
+
+				if fw.unflushed != nil {
+					cursor = fw.unflushed
+				}
+				reset = true
 				break
 			}
 
 			cursor = cursor.Next()
+
+			if c.SettleCount > 0 {
+				c.settle(sent, n.sentAt, fw.unflushed)
+			}
+		}
+
+		// Batched notifications that weren't flushed need to be resent
+		if cursor == nil {
+			cursor = fw.unflushed
+		}
+
+		if reset {
+			c.connectionReset(time.Now())
 		}
+
+		fw.stop()
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}
+}
+
+// connectionReset is called when the connection was lost without an error
+// response. The gateway drops connections that send too much, so two of
+// them within ResetThrottleInterval throttle the RateLimiter.
+func (c *Client) connectionReset(now time.Time) {
+	if c.RateLimiter != nil && !c.lastReset.IsZero() && now.Sub(c.lastReset) < ResetThrottleInterval {
+		c.RateLimiter.Throttle()
 	}
+
+	c.lastReset = now
 }
 
 func readErrs(c *Conn) chan error {
@@ -3,14 +3,76 @@ package apns_test
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/timehop/apns"
 )
 
+// expiringTokenStore accepts every token until validUntil, and then takes
+// its time to reject them
+type expiringTokenStore struct {
+	validUntil time.Time
+	delay      time.Duration
+}
+
+func (s *expiringTokenStore) InvalidateToken(token string, t time.Time) error { return nil }
+func (s *expiringTokenStore) TokenSucceeded(token string, t time.Time) error  { return nil }
+func (s *expiringTokenStore) LastSuccess(token string) (time.Time, bool, error) {
+	return time.Time{}, false, nil
+}
+
+func (s *expiringTokenStore) TokenValid(token string) (bool, error) {
+	if time.Now().Before(s.validUntil) {
+		return true, nil
+	}
+
+	time.Sleep(s.delay)
+	return false, nil
+}
+
+// blockingTokenStore records successes once release is closed
+type blockingTokenStore struct {
+	*apns.MemoryTokenStore
+	release chan struct{}
+}
+
+func (s *blockingTokenStore) TokenSucceeded(token string, t time.Time) error {
+	<-s.release
+	return s.MemoryTokenStore.TokenSucceeded(token, t)
+}
+
+// deferFilter defers every notification until a fixed time
+type deferFilter struct {
+	until time.Time
+}
+
+func (f deferFilter) FilterSend(n *apns.Notification, now time.Time) (time.Time, error) {
+	return f.until, nil
+}
+
+type mockResultHandler struct {
+	successes chan apns.Notification
+	failures  chan apns.Notification
+	drops     chan apns.Notification
+}
+
+func newMockResultHandler() *mockResultHandler {
+	return &mockResultHandler{
+		successes: make(chan apns.Notification, 100),
+		failures:  make(chan apns.Notification, 100),
+		drops:     make(chan apns.Notification, 100),
+	}
+}
+
+func (h *mockResultHandler) OnSuccess(n apns.Notification)            { h.successes <- n }
+func (h *mockResultHandler) OnFailure(n apns.Notification, err error) { h.failures <- n }
+func (h *mockResultHandler) OnDropped(n apns.Notification, err error) { h.drops <- n }
+
 var _ = Describe("Client", func() {
 	Describe(".NewConn", func() {
 		Context("bad cert/key pair", func() {
@@ -68,6 +130,54 @@ var _ = Describe("Client", func() {
 		})
 	})
 
+	Describe(".NewClientWithP12", func() {
+		Context("missing file", func() {
+			It("should error out", func() {
+				_, err := apns.NewClientWithP12(apns.ProductionGateway, "missing.p12", DummyP12Password)
+				Expect(err).NotTo(BeNil())
+			})
+		})
+
+		Context("valid bundle", func() {
+			var p12File *os.File
+
+			BeforeEach(func() {
+				p12File, _ = ioutil.TempFile("", "cert.p12")
+				p12File.Write(DummyP12)
+				p12File.Close()
+			})
+
+			AfterEach(func() {
+				if p12File != nil {
+					os.Remove(p12File.Name())
+				}
+			})
+
+			It("should create a valid client", func() {
+				c, err := apns.NewClientWithP12(apns.ProductionGateway, p12File.Name(), DummyP12Password)
+				Expect(err).To(BeNil())
+				Expect(c.Conn).NotTo(BeNil())
+			})
+		})
+	})
+
+	Describe(".NewClientWithP12Bytes", func() {
+		Context("bad password", func() {
+			It("should error out", func() {
+				_, err := apns.NewClientWithP12Bytes(apns.ProductionGateway, DummyP12, "wrong")
+				Expect(err).NotTo(BeNil())
+			})
+		})
+
+		Context("valid bundle", func() {
+			It("should create a valid client", func() {
+				c, err := apns.NewClientWithP12Bytes(apns.ProductionGateway, DummyP12, DummyP12Password)
+				Expect(err).To(BeNil())
+				Expect(c.Conn).NotTo(BeNil())
+			})
+		})
+	})
+
 	Describe("#Send", func() {
 		Context("simple write", func() {
 			as := [][]serverAction{
@@ -82,7 +192,7 @@ var _ = Describe("Client", func() {
 					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
 					c.Conn.Conf.InsecureSkipVerify = true
 
-					Expect(c.Send(apns.Notification{})).To(BeNil())
+					Expect(c.Send(apns.Notification{DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"})).To(BeNil())
 
 					close(mockDone)
 					close(d)
@@ -104,7 +214,7 @@ var _ = Describe("Client", func() {
 					c.Conn.Conf.InsecureSkipVerify = true
 
 					for i := 0; i < 54; i++ {
-						Expect(c.Send(apns.Notification{})).To(BeNil())
+						Expect(c.Send(apns.Notification{DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"})).To(BeNil())
 					}
 
 					close(mockDone)
@@ -127,8 +237,8 @@ var _ = Describe("Client", func() {
 					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
 					c.Conn.Conf.InsecureSkipVerify = true
 
-					Expect(c.Send(apns.Notification{})).To(BeNil())
-					Expect(c.Send(apns.Notification{})).To(BeNil())
+					Expect(c.Send(apns.Notification{DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"})).To(BeNil())
+					Expect(c.Send(apns.Notification{DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"})).To(BeNil())
 
 					close(mockDone)
 					close(d)
@@ -137,7 +247,7 @@ var _ = Describe("Client", func() {
 		})
 
 		Context("bad push", func() {
-			n := apns.Notification{Identifier: 9, ID: "some_rando"}
+			n := apns.Notification{Identifier: 9, ID: "some_rando", DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
 			nb, _ := n.ToBinary()
 			nbcb := make([]byte, len(nb))
 
@@ -180,131 +290,1258 @@ var _ = Describe("Client", func() {
 			})
 		})
 
-		Context("closed, reconnect", func() {
-			done := make(chan bool)
+		Context("bad push with a reused identifier", func() {
+			n1 := apns.Notification{Identifier: 5, ID: "a", DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+			n2 := apns.Notification{Identifier: 5, ID: "b", DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+
+			// The second one is written with the next free identifier
+			w2 := n2
+			w2.Identifier = 1
 
-			n1 := apns.Notification{Identifier: 1}
 			n1b, _ := n1.ToBinary()
+			w2b, _ := w2.ToBinary()
 			n1bcb := make([]byte, len(n1b))
+			w2bcb := make([]byte, len(w2b))
 
 			errPayload := bytes.NewBuffer([]byte{})
 			binary.Write(errPayload, binary.BigEndian, uint8(8))
 			binary.Write(errPayload, binary.BigEndian, uint8(8))
-			binary.Write(errPayload, binary.BigEndian, uint32(2))
+			binary.Write(errPayload, binary.BigEndian, uint32(1))
 
-			It("should not return an error", func(d Done) {
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}},
+					serverAction{action: readAction, data: n1bcb, cb: func(a serverAction) {
+						Expect(a.data).To(Equal(n1b))
+					}},
+					serverAction{action: readAction, data: w2bcb, cb: func(a serverAction) {
+						Expect(a.data).To(Equal(w2b))
+					}},
+					serverAction{action: writeAction, data: errPayload.Bytes()},
+					serverAction{action: closeAction, data: []byte{}},
+				},
+			}
+
+			It("should report the right notification", func(d Done) {
 				mockDone := make(chan interface{})
+				withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+					c.Conn.Conf.InsecureSkipVerify = true
 
-				as := [][]serverAction{
-					[]serverAction{
-						// Write error
-						serverAction{action: writeAction, data: errPayload.Bytes(), cb: func(a serverAction) {
-							done <- true
-						}},
+					go func() {
+						n := <-c.FailedNotifs
 
-						// Close on error
-						serverAction{action: closeAction, cb: func(a serverAction) {
-						}},
-					},
-					[]serverAction{
-						// Reconnect
-						serverAction{action: readAction, data: []byte{}, cb: func(a serverAction) {
-							// Reconnected
-						}},
+						Expect(n.Notif.ID).To(Equal("b"))
+						Expect(n.Notif.Identifier).To(Equal(uint32(5)))
+						Expect(n.Err.Identifier).To(Equal(uint32(1)))
 
-						// Read first good notification
-						serverAction{action: readAction, data: n1bcb, cb: func(a serverAction) {
-							Expect(a.data).To(Equal(n1b))
+						close(mockDone)
+						close(d)
+					}()
 
-							close(mockDone)
-							close(d)
-						}},
-					},
-				}
+					Expect(c.Send(n1)).To(BeNil())
+					Expect(c.Send(n2)).To(BeNil())
+				})
+			})
+		})
+
+		Context("bad push without an identifier", func() {
+			n := apns.Notification{ID: "unnumbered", DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+
+			w := n
+			w.Identifier = 1
+
+			wb, _ := w.ToBinary()
+			wbcb := make([]byte, len(wb))
+
+			errPayload := bytes.NewBuffer([]byte{})
+			binary.Write(errPayload, binary.BigEndian, uint8(8))
+			binary.Write(errPayload, binary.BigEndian, uint8(8))
+			binary.Write(errPayload, binary.BigEndian, uint32(1))
+
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}},
+					serverAction{action: readAction, data: wbcb, cb: func(a serverAction) {
+						Expect(a.data).To(Equal(wb))
+					}},
+					serverAction{action: writeAction, data: errPayload.Bytes()},
+					serverAction{action: closeAction, data: []byte{}},
+				},
+			}
 
+			It("should report it", func(d Done) {
+				mockDone := make(chan interface{})
 				withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
 					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
 					c.Conn.Conf.InsecureSkipVerify = true
 
-					<-done
-					time.Sleep(5 * time.Millisecond)
+					go func() {
+						n := <-c.FailedNotifs
 
-					// Good
-					Expect(c.Send(n1)).To(BeNil())
+						Expect(n.Notif.ID).To(Equal("unnumbered"))
+						Expect(n.Notif.Identifier).To(Equal(uint32(0)))
+
+						close(mockDone)
+						close(d)
+					}()
+
+					Expect(c.Send(n)).To(BeNil())
 				})
 			})
 		})
 
-		Context("good, close, good, requeue of last good", func() {
-			closed := make(chan bool)
-
-			n1 := apns.Notification{Identifier: 1}
-			n2 := apns.Notification{Identifier: 2}
+		Context("failures with nobody receiving", func() {
+			n1 := apns.Notification{Identifier: 1, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+			n2 := apns.Notification{Identifier: 2, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
 
 			n1b, _ := n1.ToBinary()
 			n2b, _ := n2.ToBinary()
 
-			n1bcb := make([]byte, len(n1b))
-			n2bcb := make([]byte, len(n2b))
+			errFor := func(id uint32) []byte {
+				b := bytes.NewBuffer([]byte{})
+				binary.Write(b, binary.BigEndian, uint8(8))
+				binary.Write(b, binary.BigEndian, uint8(8))
+				binary.Write(b, binary.BigEndian, id)
+				return b.Bytes()
+			}
 
-			It("should not return an error", func(d Done) {
-				mockDone := make(chan interface{})
-				as := [][]serverAction{
+			// n1 is rejected, and n2 is resent and rejected after reconnecting
+			actions := func() [][]serverAction {
+				return [][]serverAction{
 					[]serverAction{
-						// Connect
-						serverAction{action: readAction, data: []byte{}, cb: func(a serverAction) {
-							// Handshake
-						}},
-
-						// Read first good notification
-						serverAction{action: readAction, data: n1bcb, cb: func(a serverAction) {
-							Expect(a.data).To(Equal(n1b))
-						}},
-
-						// Close on error
-						serverAction{action: closeAction, cb: func(a serverAction) {
-							closed <- true
-						}},
+						serverAction{action: readAction, data: []byte{}},
+						serverAction{action: readAction, data: make([]byte, len(n1b))},
+						serverAction{action: readAction, data: make([]byte, len(n2b))},
+						serverAction{action: writeAction, data: errFor(1)},
+						serverAction{action: closeAction, data: []byte{}},
 					},
 					[]serverAction{
-						// Reconnect
-						serverAction{action: readAction, data: []byte{}, cb: func(a serverAction) {
-							// Reconnected
-						}},
-
-						// Requeue
-						serverAction{action: readAction, data: n2bcb, cb: func(a serverAction) {
-							Expect(a.data).To(Equal(n2b))
-
-							close(mockDone)
-							close(d)
-						}},
+						serverAction{action: readAction, data: []byte{}},
+						serverAction{action: readAction, data: make([]byte, len(n2b))},
+						serverAction{action: writeAction, data: errFor(2)},
+						serverAction{action: closeAction, data: []byte{}},
 					},
 				}
+			}
 
-				withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+			It("should drop and count new failures by default", func(d Done) {
+				mockDone := make(chan interface{})
+				withMockServerAsync(actions(), mockDone, func(s *mockTLSServer) {
 					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
 					c.Conn.Conf.InsecureSkipVerify = true
+					c.FailedNotifs = make(chan apns.NotificationResult, 1)
 
-					// Good
 					Expect(c.Send(n1)).To(BeNil())
+					Expect(c.Send(n2)).To(BeNil())
 
-					<-closed
-					time.Sleep(5 * time.Millisecond)
+					Eventually(c.FailuresLost).Should(Equal(uint64(1)))
+					Expect((<-c.FailedNotifs).Notif.Identifier).To(Equal(uint32(1)))
 
-					// Good
+					close(mockDone)
+					close(d)
+				})
+			}, 5)
+
+			It("should drop the oldest failures when asked to", func(d Done) {
+				mockDone := make(chan interface{})
+				withMockServerAsync(actions(), mockDone, func(s *mockTLSServer) {
+					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+					c.Conn.Conf.InsecureSkipVerify = true
+					c.FailedNotifs = make(chan apns.NotificationResult, 1)
+					c.FailureOverflow = apns.OverflowDropOldest
+
+					Expect(c.Send(n1)).To(BeNil())
+					Expect(c.Send(n2)).To(BeNil())
+
+					Eventually(c.FailuresLost).Should(Equal(uint64(1)))
+					Expect((<-c.FailedNotifs).Notif.Identifier).To(Equal(uint32(2)))
+
+					close(mockDone)
+					close(d)
+				})
+			}, 5)
+
+			It("should drop new failures when dropping the oldest from an unbuffered channel", func(d Done) {
+				mockDone := make(chan interface{})
+				withMockServerAsync(actions(), mockDone, func(s *mockTLSServer) {
+					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+					c.Conn.Conf.InsecureSkipVerify = true
+					c.FailedNotifs = make(chan apns.NotificationResult)
+					c.FailureOverflow = apns.OverflowDropOldest
+
+					Expect(c.Send(n1)).To(BeNil())
 					Expect(c.Send(n2)).To(BeNil())
+
+					Eventually(c.FailuresLost).Should(Equal(uint64(2)))
+
+					close(mockDone)
+					close(d)
 				})
+			}, 5)
+		})
+
+		Context("invalid notification", func() {
+			It("should return every problem", func() {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+
+				exp := time.Now().Add(-time.Minute)
+				err := c.Send(apns.Notification{DeviceToken: "nope", Priority: 7, Expiration: &exp})
+
+				Expect(errors.Is(err, apns.ErrBadDeviceToken)).To(BeTrue())
+				Expect(errors.Is(err, apns.ErrBadPriority)).To(BeTrue())
+				Expect(errors.Is(err, apns.ErrExpired)).To(BeTrue())
 			})
 		})
 
-		Context("good, bad, good, requeue of last good", func() {
-			It("should not return an error", func(d Done) {
+		Context("invalidated token", func() {
+			It("should return an error", func() {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+
+				c.TokenStore = apns.NewMemoryTokenStore()
+				c.TokenStore.InvalidateToken("00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535", time.Now())
+
+				n := apns.Notification{DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+				Expect(c.Send(n)).To(Equal(apns.ErrTokenInvalidated))
+			})
+		})
+
+		Context("rate limited", func() {
+			It("should return an error", func() {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+
+				c.RateLimiter = apns.NewRateLimiter(1, 1)
+				c.RateLimiter.Allow("00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535")
+
+				n := apns.Notification{DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+				Expect(c.Send(n)).To(Equal(apns.ErrRateLimited))
+			})
+		})
+
+		Context("duplicate", func() {
+			It("should return an error", func() {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+
+				n := apns.Notification{ID: "a", DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+
+				c.Dedupe = apns.NewDeduplicator(time.Minute)
+				c.Dedupe.Seen(n)
+
+				Expect(c.Send(n)).To(Equal(apns.ErrDuplicate))
+				Expect(c.Dedupe.Dropped()).To(Equal(uint64(1)))
+			})
+		})
+
+		Context("duplicate with a rate limiter", func() {
+			It("should not count against the limit", func() {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+				c.RateLimiter = apns.NewRateLimiter(1, 1)
+				c.RateLimiter.Block = true
+
+				n := apns.Notification{ID: "a", DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+
+				c.Dedupe = apns.NewDeduplicator(time.Minute)
+				c.Dedupe.Seen(n)
+
+				Expect(c.Send(n)).To(Equal(apns.ErrDuplicate))
+				Expect(c.RateLimiter.Stats()).To(Equal(apns.RateLimiterStats{}))
+			})
+		})
+
+		Context("retry after being rate limited", func() {
+			It("should not be a duplicate", func() {
+				tok := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+				c.Dedupe = apns.NewDeduplicator(time.Minute)
+				c.RateLimiter = apns.NewRateLimiter(0.001, 1)
+				c.RateLimiter.Allow(tok)
+
+				n := apns.Notification{ID: "a", DeviceToken: tok}
+
+				Expect(c.Send(n)).To(Equal(apns.ErrRateLimited))
+				Expect(c.Send(n)).To(Equal(apns.ErrRateLimited))
+				Expect(c.Dedupe.Dropped()).To(BeZero())
+			})
+		})
+
+		Context("retry after the outbox failed", func() {
+			It("should not be a duplicate", func() {
+				dir, _ := ioutil.TempDir("", "apns-dedupe")
+				defer os.RemoveAll(dir)
+
+				o, _ := apns.OpenFileOutbox(filepath.Join(dir, "outbox"))
+				o.Close()
+
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+				c.Dedupe = apns.NewDeduplicator(time.Minute)
+				c.Outbox = o
+
+				n := apns.Notification{ID: "a", DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+
+				Expect(c.Send(n)).NotTo(BeNil())
+				Expect(c.Send(n)).NotTo(Equal(apns.ErrDuplicate))
+				Expect(c.Dedupe.Dropped()).To(BeZero())
+			})
+		})
+
+		Context("bad push with a token store", func() {
+			n := apns.Notification{Identifier: 9, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+			nb, _ := n.ToBinary()
+			nbcb := make([]byte, len(nb))
+
+			errPayload := bytes.NewBuffer([]byte{})
+			binary.Write(errPayload, binary.BigEndian, uint8(8))
+			binary.Write(errPayload, binary.BigEndian, uint8(8))
+			binary.Write(errPayload, binary.BigEndian, uint32(9))
+
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}},
+					serverAction{action: readAction, data: nbcb},
+					serverAction{action: writeAction, data: errPayload.Bytes()},
+					serverAction{action: closeAction, data: []byte{}},
+				},
+			}
+
+			It("should invalidate the token", func(d Done) {
+				mockDone := make(chan interface{})
+				withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+					c.Conn.Conf.InsecureSkipVerify = true
+
+					store := apns.NewMemoryTokenStore()
+					c.TokenStore = store
+
+					go func() {
+						<-c.FailedNotifs
+
+						valid, _ := store.TokenValid(n.DeviceToken)
+						Expect(valid).To(BeFalse())
+						Expect(c.Send(n)).To(Equal(apns.ErrTokenInvalidated))
+
+						close(mockDone)
+						close(d)
+					}()
+
+					Expect(c.Send(n)).To(BeNil())
+				})
+			})
+		})
+
+		Context("with an outbox", func() {
+			var dir string
+
+			BeforeEach(func() {
+				dir, _ = ioutil.TempDir("", "outbox")
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(dir)
+			})
+
+			n := apns.Notification{Identifier: 9, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535", Payload: apns.NewPayload()}
+			nb, _ := n.ToBinary()
+			nbcb := make([]byte, len(nb))
+
+			errPayload := bytes.NewBuffer([]byte{})
+			binary.Write(errPayload, binary.BigEndian, uint8(8))
+			binary.Write(errPayload, binary.BigEndian, uint8(8))
+			binary.Write(errPayload, binary.BigEndian, uint32(9))
+
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}},
+					serverAction{action: readAction, data: nbcb, cb: func(a serverAction) {
+						Expect(a.data).To(Equal(nb))
+					}},
+					serverAction{action: writeAction, data: errPayload.Bytes()},
+					serverAction{action: closeAction, data: []byte{}},
+				},
+			}
+
+			It("should replay pending notifications and mark failures", func(d Done) {
+				path := filepath.Join(dir, "outbox")
+
+				// Left behind by a previous client
+				o, _ := apns.OpenFileOutbox(path)
+				o.Add(n)
+
+				mockDone := make(chan interface{})
+				withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+					c.Conn.Conf.InsecureSkipVerify = true
+
+					go func() {
+						<-c.FailedNotifs
+
+						es, _ := o.Pending()
+						Expect(es).To(BeEmpty())
+
+						o.Close()
+						close(mockDone)
+						close(d)
+					}()
+
+					Expect(c.UseOutbox(o)).To(BeNil())
+				})
+			})
+
+			Context("deferred notification", func() {
+				tok := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+				It("should be kept until it's sent", func() {
+					o, _ := apns.OpenFileOutbox(filepath.Join(dir, "outbox"))
+					defer o.Close()
+
+					c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+					c.Filters = []apns.SendFilter{deferFilter{until: time.Now().Add(time.Hour)}}
+					Expect(c.UseOutbox(o)).To(BeNil())
+
+					Expect(c.Send(apns.Notification{ID: "later", DeviceToken: tok})).To(BeNil())
+
+					es, _ := o.Pending()
+					Expect(es).To(HaveLen(1))
+					Expect(es[0].Notif.ID).To(Equal("later"))
+				})
+
+				It("should be deferred again after a restart", func(d Done) {
+					o, _ := apns.OpenFileOutbox(filepath.Join(dir, "outbox"))
+					defer o.Close()
+					o.Add(apns.Notification{ID: "later", DeviceToken: tok})
+
+					c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+					c.Filters = []apns.SendFilter{deferFilter{until: time.Now().Add(50 * time.Millisecond)}}
+
+					// The token is invalidated while it's deferred, so it's
+					// rejected when its time comes
+					h := newMockResultHandler()
+					c.ResultHandler = h
+					c.TokenStore = &expiringTokenStore{validUntil: time.Now().Add(20 * time.Millisecond)}
+
+					Expect(c.UseOutbox(o)).To(BeNil())
+
+					Expect((<-h.drops).ID).To(Equal("later"))
+					es, _ := o.Pending()
+					Expect(es).To(BeEmpty())
+
+					close(d)
+				}, 5)
+			})
+
+			Context("replaying", func() {
+				tok := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+				It("should drop expired notifications", func(d Done) {
+					o, _ := apns.OpenFileOutbox(filepath.Join(dir, "outbox"))
+					defer o.Close()
+
+					exp := time.Now().Add(-time.Minute)
+					o.Add(apns.Notification{ID: "expired", DeviceToken: tok, Expiration: &exp})
+
+					c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+					h := newMockResultHandler()
+					c.ResultHandler = h
+
+					Expect(c.UseOutbox(o)).To(BeNil())
+
+					Expect((<-h.drops).ID).To(Equal("expired"))
+					es, _ := o.Pending()
+					Expect(es).To(BeEmpty())
+
+					close(d)
+				}, 5)
+
+				It("should drop notifications to invalidated tokens", func(d Done) {
+					o, _ := apns.OpenFileOutbox(filepath.Join(dir, "outbox"))
+					defer o.Close()
+					o.Add(apns.Notification{ID: "invalid", DeviceToken: tok})
+
+					store := apns.NewMemoryTokenStore()
+					store.InvalidateToken(tok, time.Now())
+
+					c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+					h := newMockResultHandler()
+					c.ResultHandler = h
+					c.TokenStore = store
+
+					Expect(c.UseOutbox(o)).To(BeNil())
+
+					Expect((<-h.drops).ID).To(Equal("invalid"))
+					es, _ := o.Pending()
+					Expect(es).To(BeEmpty())
+
+					close(d)
+				}, 5)
+			})
+
+			Context("without a settle time or count", func() {
+				It("should confirm notifications after DefaultOutboxSettleTime", func() {
+					o, _ := apns.OpenFileOutbox(filepath.Join(dir, "outbox"))
+					defer o.Close()
+
+					c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+					Expect(c.UseOutbox(o)).To(BeNil())
+
+					Expect(c.SettleTime).To(Equal(apns.DefaultOutboxSettleTime))
+				})
+
+				It("should keep a settle count", func() {
+					o, _ := apns.OpenFileOutbox(filepath.Join(dir, "outbox"))
+					defer o.Close()
+
+					c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+					c.SettleCount = 10
+					Expect(c.UseOutbox(o)).To(BeNil())
+
+					Expect(c.SettleTime).To(BeZero())
+				})
+			})
+
+			It("should not wait for the gateway", func(d Done) {
+				o, _ := apns.OpenFileOutbox(filepath.Join(dir, "outbox"))
+				defer o.Close()
+				o.Add(n)
+
+				// Never started, so nothing accepts connections
+				s := &mockTLSServer{}
+
+				c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+
+				Expect(c.UseOutbox(o)).To(BeNil())
+				close(d)
+			}, 1)
+		})
+
+		Context("with a result handler", func() {
+			tok := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+			Context("notification out of the resend buffer", func() {
+				as := [][]serverAction{
+					[]serverAction{
+						serverAction{action: readAction, data: []byte{}},
+					},
+				}
+
+				It("should report a success", func(d Done) {
+					mockDone := make(chan interface{})
+					withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+						c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+						c.Conn.Conf.InsecureSkipVerify = true
+
+						h := newMockResultHandler()
+						c.ResultHandler = h
+
+						Expect(c.Send(apns.Notification{ID: "first", DeviceToken: tok})).To(BeNil())
+						for i := 0; i < 50; i++ {
+							Expect(c.Send(apns.Notification{DeviceToken: tok})).To(BeNil())
+						}
+
+						Expect((<-h.successes).ID).To(Equal("first"))
+
+						close(mockDone)
+						close(d)
+					})
+				})
+			})
+
+			Context("with a settle count", func() {
+				as := [][]serverAction{
+					[]serverAction{
+						serverAction{action: readAction, data: []byte{}},
+					},
+				}
+
+				It("should report a success after that many notifications", func(d Done) {
+					mockDone := make(chan interface{})
+					withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+						c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+						c.Conn.Conf.InsecureSkipVerify = true
+
+						h := newMockResultHandler()
+						c.ResultHandler = h
+						c.SettleCount = 1
+
+						Expect(c.Send(apns.Notification{ID: "first", DeviceToken: tok})).To(BeNil())
+						Expect(c.Send(apns.Notification{ID: "second", DeviceToken: tok})).To(BeNil())
+
+						Expect((<-h.successes).ID).To(Equal("first"))
+						Consistently(h.successes).ShouldNot(Receive())
+
+						close(mockDone)
+						close(d)
+					})
+				})
+			})
+
+			Context("with a slow token store", func() {
+				as := [][]serverAction{
+					[]serverAction{
+						serverAction{action: readAction, data: []byte{}},
+					},
+				}
+
+				It("should record successes without holding up the writes", func(d Done) {
+					mockDone := make(chan interface{})
+					withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+						c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+						c.Conn.Conf.InsecureSkipVerify = true
+
+						store := &blockingTokenStore{MemoryTokenStore: apns.NewMemoryTokenStore(), release: make(chan struct{})}
+						h := newMockResultHandler()
+						c.ResultHandler = h
+						c.TokenStore = store
+						c.SettleCount = 1
+
+						for _, id := range []string{"first", "second", "third"} {
+							Expect(c.Send(apns.Notification{ID: id, DeviceToken: tok})).To(BeNil())
+						}
+
+						Expect((<-h.successes).ID).To(Equal("first"))
+						Expect((<-h.successes).ID).To(Equal("second"))
+
+						close(store.release)
+						Eventually(func() bool {
+							_, ok, _ := store.LastSuccess(tok)
+							return ok
+						}).Should(BeTrue())
+
+						close(mockDone)
+						close(d)
+					})
+				})
+			})
+
+			Context("with a settle time", func() {
+				as := [][]serverAction{
+					[]serverAction{
+						serverAction{action: readAction, data: []byte{}},
+					},
+				}
+
+				It("should report a success after that long", func(d Done) {
+					mockDone := make(chan interface{})
+					withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+						c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+						c.Conn.Conf.InsecureSkipVerify = true
+
+						h := newMockResultHandler()
+						c.ResultHandler = h
+						c.SettleTime = 50 * time.Millisecond
+
+						start := time.Now()
+						Expect(c.Send(apns.Notification{ID: "first", DeviceToken: tok})).To(BeNil())
+
+						Expect((<-h.successes).ID).To(Equal("first"))
+						Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+
+						close(mockDone)
+						close(d)
+					})
+				})
+			})
+
+			Context("with sentinels", func() {
+				n := apns.Notification{Identifier: 1, ID: "first", DeviceToken: tok}
+				nb, _ := n.ToBinary()
+
+				sentinel := apns.Notification{Identifier: 2, DeviceToken: "0000000000000000000000000000000000000000000000000000000000000000", Payload: apns.NewPayload()}
+				sb, _ := sentinel.ToBinary()
+				sbcb := make([]byte, len(sb))
+
+				errPayload := bytes.NewBuffer([]byte{})
+				binary.Write(errPayload, binary.BigEndian, uint8(8))
+				binary.Write(errPayload, binary.BigEndian, uint8(8))
+				binary.Write(errPayload, binary.BigEndian, uint32(2))
+
+				as := [][]serverAction{
+					[]serverAction{
+						serverAction{action: readAction, data: []byte{}},
+						serverAction{action: readAction, data: make([]byte, len(nb))},
+						serverAction{action: readAction, data: sbcb, cb: func(a serverAction) {
+							Expect(a.data).To(Equal(sb))
+						}},
+						serverAction{action: writeAction, data: errPayload.Bytes()},
+						serverAction{action: closeAction, data: []byte{}},
+					},
+				}
+
+				It("should report a success when the sentinel is rejected", func(d Done) {
+					mockDone := make(chan interface{})
+					withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+						c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+						c.Conn.Conf.InsecureSkipVerify = true
+
+						h := newMockResultHandler()
+						c.ResultHandler = h
+						c.SentinelInterval = 20 * time.Millisecond
+
+						Expect(c.Send(n)).To(BeNil())
+
+						Expect((<-h.successes).ID).To(Equal("first"))
+						Consistently(c.FailedNotifs).ShouldNot(Receive())
+						Expect(h.failures).To(BeEmpty())
+
+						close(mockDone)
+						close(d)
+					})
+				})
+			})
+
+			Context("identifier of a settled notification", func() {
+				n1 := apns.Notification{Identifier: 7, DeviceToken: tok}
+				n2 := apns.Notification{DeviceToken: tok}
+				n3 := apns.Notification{Identifier: 7, DeviceToken: tok}
+
+				n1b, _ := n1.ToBinary()
+
+				// 7 is still reserved, and n2 has 1
+				w3 := n3
+				w3.Identifier = 2
+				w3b, _ := w3.ToBinary()
+
+				It("should not be reused", func(d Done) {
+					mockDone := make(chan interface{})
+
+					as := [][]serverAction{
+						[]serverAction{
+							serverAction{action: readAction, data: []byte{}},
+							serverAction{action: readAction, data: make([]byte, len(n1b))},
+							serverAction{action: readAction, data: make([]byte, len(n1b))},
+							serverAction{action: readAction, data: make([]byte, len(w3b)), cb: func(a serverAction) {
+								Expect(a.data).To(Equal(w3b))
+
+								close(mockDone)
+								close(d)
+							}},
+						},
+					}
+
+					withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+						c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+						c.Conn.Conf.InsecureSkipVerify = true
+
+						h := newMockResultHandler()
+						c.ResultHandler = h
+						c.SettleCount = 1
+
+						Expect(c.Send(n1)).To(BeNil())
+						Expect(c.Send(n2)).To(BeNil())
+						Eventually(h.successes).Should(Receive())
+						Expect(c.Send(n3)).To(BeNil())
+					})
+				})
+			})
+
+			Context("error for a settled notification", func() {
+				n1 := apns.Notification{Identifier: 1, ID: "first", DeviceToken: tok}
+				n2 := apns.Notification{Identifier: 2, ID: "second", DeviceToken: tok}
+
+				n1b, _ := n1.ToBinary()
+				n2b, _ := n2.ToBinary()
+
+				errPayload := bytes.NewBuffer([]byte{})
+				binary.Write(errPayload, binary.BigEndian, uint8(8))
+				binary.Write(errPayload, binary.BigEndian, uint8(8))
+				binary.Write(errPayload, binary.BigEndian, uint32(1))
+
+				It("should report it, and resend the ones after it", func(d Done) {
+					mockDone := make(chan interface{})
+
+					as := [][]serverAction{
+						[]serverAction{
+							serverAction{action: readAction, data: []byte{}},
+							serverAction{action: readAction, data: make([]byte, len(n1b))},
+							serverAction{action: readAction, data: make([]byte, len(n2b))},
+							serverAction{action: writeAction, data: errPayload.Bytes()},
+							serverAction{action: closeAction},
+						},
+						[]serverAction{
+							serverAction{action: readAction, data: []byte{}},
+							serverAction{action: readAction, data: make([]byte, len(n2b)), cb: func(a serverAction) {
+								Expect(a.data).To(Equal(n2b))
+
+								close(mockDone)
+							}},
+						},
+					}
+
+					withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+						c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+						c.Conn.Conf.InsecureSkipVerify = true
+
+						h := newMockResultHandler()
+						c.ResultHandler = h
+						c.SettleCount = 1
+
+						Expect(c.Send(n1)).To(BeNil())
+						Expect(c.Send(n2)).To(BeNil())
+
+						Expect((<-h.successes).ID).To(Equal("first"))
+						Expect((<-h.failures).ID).To(Equal("first"))
+						Consistently(h.successes).ShouldNot(Receive())
+
+						close(d)
+					})
+				})
+			})
+
+			Context("error matching no notification", func() {
+				n := apns.Notification{Identifier: 1, ID: "first", DeviceToken: tok}
+				nb, _ := n.ToBinary()
+
+				errPayload := bytes.NewBuffer([]byte{})
+				binary.Write(errPayload, binary.BigEndian, uint8(8))
+				binary.Write(errPayload, binary.BigEndian, uint8(8))
+				binary.Write(errPayload, binary.BigEndian, uint32(9))
+
+				It("should resend the notifications, not confirm them", func(d Done) {
+					mockDone := make(chan interface{})
+
+					as := [][]serverAction{
+						[]serverAction{
+							serverAction{action: readAction, data: []byte{}},
+							serverAction{action: readAction, data: make([]byte, len(nb))},
+							serverAction{action: writeAction, data: errPayload.Bytes()},
+							serverAction{action: closeAction},
+						},
+						[]serverAction{
+							serverAction{action: readAction, data: []byte{}},
+							serverAction{action: readAction, data: make([]byte, len(nb)), cb: func(a serverAction) {
+								Expect(a.data).To(Equal(nb))
+
+								close(mockDone)
+							}},
+						},
+					}
+
+					withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+						c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+						c.Conn.Conf.InsecureSkipVerify = true
+
+						h := newMockResultHandler()
+						c.ResultHandler = h
+
+						Expect(c.Send(n)).To(BeNil())
+
+						<-mockDone
+						Expect(h.successes).To(BeEmpty())
+						Expect(h.failures).To(BeEmpty())
+
+						close(d)
+					})
+				})
+			})
+
+			Context("bad push", func() {
+				n := apns.Notification{Identifier: 9, ID: "bad", DeviceToken: tok}
+				nb, _ := n.ToBinary()
+				nbcb := make([]byte, len(nb))
+
+				errPayload := bytes.NewBuffer([]byte{})
+				binary.Write(errPayload, binary.BigEndian, uint8(8))
+				binary.Write(errPayload, binary.BigEndian, uint8(8))
+				binary.Write(errPayload, binary.BigEndian, uint32(9))
+
+				as := [][]serverAction{
+					[]serverAction{
+						serverAction{action: readAction, data: []byte{}},
+						serverAction{action: readAction, data: nbcb},
+						serverAction{action: writeAction, data: errPayload.Bytes()},
+						serverAction{action: closeAction, data: []byte{}},
+					},
+				}
+
+				It("should report a failure", func(d Done) {
+					mockDone := make(chan interface{})
+					withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+						c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+						c.Conn.Conf.InsecureSkipVerify = true
+
+						h := newMockResultHandler()
+						c.ResultHandler = h
+
+						Expect(c.Send(n)).To(BeNil())
+						Expect((<-h.failures).ID).To(Equal("bad"))
+
+						close(mockDone)
+						close(d)
+					})
+				})
+			})
+
+			Context("deferred notifications due at once", func() {
+				n1 := apns.Notification{Identifier: 1, DeviceToken: tok}
+				n2 := apns.Notification{Identifier: 2, DeviceToken: tok}
+				n3 := apns.Notification{Identifier: 3, DeviceToken: tok}
+
+				n1b, _ := n1.ToBinary()
+
+				It("should wait for the rate limiter", func(d Done) {
+					mockDone := make(chan interface{})
+
+					as := [][]serverAction{
+						[]serverAction{
+							serverAction{action: readAction, data: []byte{}},
+							serverAction{action: readAction, data: make([]byte, len(n1b))},
+							serverAction{action: readAction, data: make([]byte, len(n1b))},
+							serverAction{action: readAction, data: make([]byte, len(n1b)), cb: func(a serverAction) {
+								close(mockDone)
+							}},
+						},
+					}
+
+					withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+						c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+						c.Conn.Conf.InsecureSkipVerify = true
+
+						h := newMockResultHandler()
+						c.ResultHandler = h
+						c.RateLimiter = apns.NewRateLimiter(50, 1)
+						c.Filters = []apns.SendFilter{deferFilter{until: time.Now().Add(20 * time.Millisecond)}}
+
+						Expect(c.Send(n1)).To(BeNil())
+						Expect(c.Send(n2)).To(BeNil())
+						Expect(c.Send(n3)).To(BeNil())
+
+						<-mockDone
+						Expect(h.drops).To(BeEmpty())
+						Expect(c.RateLimiter.Stats().Limited).To(BeNumerically(">", 0))
+
+						close(d)
+					})
+				})
+			})
+
+			Context("deferred notification expiring", func() {
+				It("should report it dropped", func(d Done) {
+					c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+
+					h := newMockResultHandler()
+					c.ResultHandler = h
+					c.TokenStore = &expiringTokenStore{validUntil: time.Now().Add(5 * time.Millisecond), delay: 50 * time.Millisecond}
+					c.Filters = []apns.SendFilter{deferFilter{until: time.Now().Add(10 * time.Millisecond)}}
+
+					// The second one expires while the first is being sent
+					exp := time.Now().Add(30 * time.Millisecond)
+					Expect(c.Send(apns.Notification{ID: "slow", DeviceToken: tok})).To(BeNil())
+					Expect(c.Send(apns.Notification{ID: "late", DeviceToken: tok, Expiration: &exp})).To(BeNil())
+
+					// The first one is rejected by the token store
+					Expect((<-h.drops).ID).To(Equal("slow"))
+					Expect((<-h.drops).ID).To(Equal("late"))
+					close(d)
+				})
+			})
+		})
+
+		Context("during quiet hours", func() {
+			tok := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+			var c *apns.Client
+			var o *apns.FileOutbox
+			var dir string
+
+			BeforeEach(func() {
+				dir, _ = ioutil.TempDir("", "quiet-hours")
+				o, _ = apns.OpenFileOutbox(filepath.Join(dir, "outbox"))
+
+				c, _ = apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+				c.Filters = []apns.SendFilter{deferFilter{until: time.Now().Add(time.Hour)}}
+				c.UseOutbox(o)
+			})
+
+			AfterEach(func() {
+				o.Close()
+				os.RemoveAll(dir)
+			})
+
+			It("should reject VoIP notifications on another client right away", func() {
+				n := apns.NewVoIPNotification("com.example.app")
+				n.DeviceToken = tok
+
+				Expect(c.Send(n)).To(Equal(apns.ErrVoIPClientRequired))
+
+				es, _ := o.Pending()
+				Expect(es).To(BeEmpty())
+			})
+
+			It("should reject invalidated tokens right away", func() {
+				store := apns.NewMemoryTokenStore()
+				store.InvalidateToken(tok, time.Now())
+				c.TokenStore = store
+
+				Expect(c.Send(apns.Notification{DeviceToken: tok})).To(Equal(apns.ErrTokenInvalidated))
+
+				es, _ := o.Pending()
+				Expect(es).To(BeEmpty())
+			})
+
+			It("should reject duplicates right away", func() {
+				c.Dedupe = apns.NewDeduplicator(time.Minute)
+
+				n := apns.Notification{ID: "a", DeviceToken: tok}
+				Expect(c.Send(n)).To(BeNil())
+				Expect(c.Send(n)).To(Equal(apns.ErrDuplicate))
+
+				es, _ := o.Pending()
+				Expect(es).To(HaveLen(1))
+			})
+		})
+
+		Context("closed, reconnect", func() {
+			done := make(chan bool)
+
+			n0 := apns.Notification{Identifier: 5, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+			n0b, _ := n0.ToBinary()
+
+			n1 := apns.Notification{Identifier: 1, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+			n1b, _ := n1.ToBinary()
+			n1bcb := make([]byte, len(n1b))
+
+			It("should not return an error", func(d Done) {
+				mockDone := make(chan interface{})
+
+				as := [][]serverAction{
+					[]serverAction{
+						// Connected by the first Send
+						serverAction{action: readAction, data: []byte{}},
+						serverAction{action: readAction, data: make([]byte, len(n0b))},
+
+						// Close
+						serverAction{action: closeAction, cb: func(a serverAction) {
+							done <- true
+						}},
+					},
+					[]serverAction{
+						// Reconnect
+						serverAction{action: readAction, data: []byte{}, cb: func(a serverAction) {
+							// Reconnected
+						}},
+
+						// Read first good notification
+						serverAction{action: readAction, data: n1bcb, cb: func(a serverAction) {
+							Expect(a.data).To(Equal(n1b))
+
+							close(mockDone)
+							close(d)
+						}},
+					},
+				}
+
+				withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+					c.Conn.Conf.InsecureSkipVerify = true
+
+					Expect(c.Send(n0)).To(BeNil())
+
+					<-done
+					time.Sleep(5 * time.Millisecond)
+
+					// Good
+					Expect(c.Send(n1)).To(BeNil())
+				})
+			})
+		})
+
+		Context("closed twice in a row", func() {
+			closed := make(chan bool)
+			reconnected := make(chan bool)
+
+			n := apns.Notification{DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+			nb, _ := n.ToBinary()
+
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}},
+					serverAction{action: readAction, data: make([]byte, len(nb))},
+					serverAction{action: closeAction, cb: func(a serverAction) { closed <- true }},
+				},
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}, cb: func(a serverAction) { reconnected <- true }},
+					serverAction{action: readAction, data: make([]byte, len(nb))},
+					serverAction{action: closeAction, cb: func(a serverAction) { closed <- true }},
+				},
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}},
+				},
+			}
+
+			It("should throttle the rate limiter", func(d Done) {
+				mockDone := make(chan interface{})
+				withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+					c.Conn.Conf.InsecureSkipVerify = true
+					c.RateLimiter = apns.NewRateLimiter(1000, 10)
+
+					Expect(c.Send(n)).To(BeNil())
+					<-closed
+					<-reconnected
+					Expect(c.RateLimiter.Stats().Throttles).To(BeZero())
+
+					Expect(c.Send(n)).To(BeNil())
+					<-closed
+					Eventually(func() uint64 { return c.RateLimiter.Stats().Throttles }).Should(Equal(uint64(1)))
+
+					close(mockDone)
+					close(d)
+				})
+			}, 5)
+		})
+
+		Context("good, close, good, requeue of last good", func() {
+			closed := make(chan bool)
+
+			n1 := apns.Notification{Identifier: 1, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+			n2 := apns.Notification{Identifier: 2, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+
+			n1b, _ := n1.ToBinary()
+			n2b, _ := n2.ToBinary()
+
+			n1bcb := make([]byte, len(n1b))
+			n2bcb := make([]byte, len(n2b))
+
+			It("should not return an error", func(d Done) {
+				mockDone := make(chan interface{})
+				as := [][]serverAction{
+					[]serverAction{
+						// Connect
+						serverAction{action: readAction, data: []byte{}, cb: func(a serverAction) {
+							// Handshake
+						}},
+
+						// Read first good notification
+						serverAction{action: readAction, data: n1bcb, cb: func(a serverAction) {
+							Expect(a.data).To(Equal(n1b))
+						}},
+
+						// Close on error
+						serverAction{action: closeAction, cb: func(a serverAction) {
+							closed <- true
+						}},
+					},
+					[]serverAction{
+						// Reconnect
+						serverAction{action: readAction, data: []byte{}, cb: func(a serverAction) {
+							// Reconnected
+						}},
+
+						// Requeue
+						serverAction{action: readAction, data: n2bcb, cb: func(a serverAction) {
+							Expect(a.data).To(Equal(n2b))
+
+							close(mockDone)
+							close(d)
+						}},
+					},
+				}
+
+				withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+					c.Conn.Conf.InsecureSkipVerify = true
+
+					// Good
+					Expect(c.Send(n1)).To(BeNil())
+
+					<-closed
+					time.Sleep(5 * time.Millisecond)
+
+					// Good
+					Expect(c.Send(n2)).To(BeNil())
+				})
+			})
+		})
+
+		Context("good, bad, good, requeue of last good", func() {
+			It("should not return an error", func(d Done) {
+				mockDone := make(chan interface{})
+
+				n1 := apns.Notification{Identifier: 1, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+				n2 := apns.Notification{Identifier: 2, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+				n3 := apns.Notification{Identifier: 3, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+
+				n1b, _ := n1.ToBinary()
+				n2b, _ := n2.ToBinary()
+				n3b, _ := n3.ToBinary()
+
+				n1bcb := make([]byte, len(n1b))
+				n2bcb := make([]byte, len(n2b))
+				n3bcb := make([]byte, len(n3b))
+
+				errPayload := bytes.NewBuffer([]byte{})
+				binary.Write(errPayload, binary.BigEndian, uint8(8))
+				binary.Write(errPayload, binary.BigEndian, uint8(8))
+				binary.Write(errPayload, binary.BigEndian, uint32(2))
+
+				as := [][]serverAction{
+					[]serverAction{
+						// Connect
+						serverAction{action: readAction, data: []byte{}, cb: func(a serverAction) {
+							// Handshake
+						}},
+
+						// Read first good notification
+						serverAction{action: readAction, data: n1bcb, cb: func(a serverAction) {
+							Expect(a.data).To(Equal(n1b))
+						}},
+
+						// Read bad notification
+						serverAction{action: readAction, data: n2bcb, cb: func(a serverAction) {
+							Expect(a.data).To(Equal(n2b))
+						}},
+
+						// Read second good notification
+						serverAction{action: readAction, data: n3bcb, cb: func(a serverAction) {
+							Expect(a.data).To(Equal(n3b))
+						}},
+
+						// Write error
+						serverAction{action: writeAction, data: errPayload.Bytes(), cb: func(a serverAction) {
+						}},
+
+						// Close on error
+						serverAction{action: closeAction, cb: func(a serverAction) {
+						}},
+					},
+					[]serverAction{
+						// Reconnect
+						serverAction{action: readAction, data: []byte{}, cb: func(a serverAction) {
+							// Reconnected
+						}},
+
+						// Requeue
+						serverAction{action: readAction, data: n3bcb, cb: func(a serverAction) {
+							Expect(a.data).To(Equal(n3b))
+
+							close(mockDone)
+							close(d)
+						}},
+					},
+				}
+
+				withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+					c.Conn.Conf.InsecureSkipVerify = true
+
+					// Good
+					Expect(c.Send(n1)).To(BeNil())
+
+					// Bad
+					Expect(c.Send(n2)).To(BeNil())
+
+					// Good
+					Expect(c.Send(n3)).To(BeNil())
+				})
+			})
+		})
+
+		Context("good, bad, good, requeue of last good with dedupe", func() {
+			It("should not drop the requeued notification", func(d Done) {
 				mockDone := make(chan interface{})
 
-				n1 := apns.Notification{Identifier: 1}
-				n2 := apns.Notification{Identifier: 2}
-				n3 := apns.Notification{Identifier: 3}
+				n1 := apns.Notification{ID: "1", Identifier: 1, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+				n2 := apns.Notification{ID: "2", Identifier: 2, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
+				n3 := apns.Notification{ID: "3", Identifier: 3, DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"}
 
 				n1b, _ := n1.ToBinary()
 				n2b, _ := n2.ToBinary()
@@ -368,6 +1605,7 @@ var _ = Describe("Client", func() {
 				withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
 					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
 					c.Conn.Conf.InsecureSkipVerify = true
+					c.Dedupe = apns.NewDeduplicator(time.Minute)
 
 					// Good
 					Expect(c.Send(n1)).To(BeNil())
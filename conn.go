@@ -1,9 +1,18 @@
 package apns
 
 import (
+	"context"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
 	"net"
+	"net/url"
 	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 const (
@@ -14,11 +23,44 @@ const (
 	SandboxFeedbackGateway    = "feedback.sandbox.push.apple.com:2196"
 )
 
+const (
+	// DefaultDialTimeout limits connecting to the gateway when Dialer is nil
+	// or has no Timeout
+	DefaultDialTimeout = 20 * time.Second
+
+	// DefaultKeepAlive is the TCP keepalive interval when Dialer is nil
+	DefaultKeepAlive = 30 * time.Second
+
+	// DefaultHandshakeTimeout limits the TLS handshake when HandshakeTimeout
+	// is 0
+	DefaultHandshakeTimeout = 10 * time.Second
+)
+
 // Conn is a wrapper for the actual TLS connections made to Apple
 type Conn struct {
 	NetConn net.Conn
 	Conf    *tls.Config
 
+	// Dialer makes the TCP connection, for its Timeout, KeepAlive and
+	// LocalAddr. One with DefaultDialTimeout and DefaultKeepAlive is used
+	// when it's nil.
+	Dialer *net.Dialer
+
+	// DialContext replaces Dialer when set, e.g. to dial through a tunnel or
+	// in tests. The context expires after the dial timeout.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Proxy is an http:// (using CONNECT) or socks5:// proxy URL to connect
+	// through, with optional user info for authentication. See
+	// ProxyFromEnvironment.
+	Proxy *url.URL
+
+	// Network is "tcp4" or "tcp6" to only use IPv4 or IPv6, "tcp" when empty
+	Network string
+
+	// HandshakeTimeout overrides DefaultHandshakeTimeout
+	HandshakeTimeout time.Duration
+
 	gateway   string
 	connected bool
 }
@@ -53,6 +95,66 @@ func NewConnWithFiles(gw string, certFile string, keyFile string) (Conn, error)
 	return NewConnWithCert(gw, cert), nil
 }
 
+// NewConnWithP12 creates a new Conn from a PKCS#12 (.p12) bundle, such as
+// the ones exported from Keychain Access
+func NewConnWithP12(gw string, p12 []byte, password string) (Conn, error) {
+	cert, err := certFromP12(p12, password)
+	if err != nil {
+		return Conn{}, err
+	}
+
+	return NewConnWithCert(gw, cert), nil
+}
+
+// NewConnWithP12File creates a new Conn from the PKCS#12 (.p12) bundle in the
+// specified file
+func NewConnWithP12File(gw string, p12File string, password string) (Conn, error) {
+	p12, err := ioutil.ReadFile(p12File)
+	if err != nil {
+		return Conn{}, err
+	}
+
+	return NewConnWithP12(gw, p12, password)
+}
+
+// certFromP12 decodes the private key, leaf certificate and any intermediate
+// certificates in a PKCS#12 bundle. Both legacy (3DES/RC2) and current
+// (PBES2 with AES, the OpenSSL 3 default) encryption are supported.
+func certFromP12(p12 []byte, password string) (tls.Certificate, error) {
+	key, leaf, chain, err := pkcs12.DecodeChain(p12, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	// The leaf is the certificate for the private key, wherever the bundle
+	// put it, everything else is the intermediate chain
+	certs := append([]*x509.Certificate{leaf}, chain...)
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return tls.Certificate{}, errors.New("pkcs12: unsupported private key type")
+	}
+
+	found := false
+	for i, c := range certs {
+		if pub, ok := c.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(signer.Public()) {
+			certs[0], certs[i] = certs[i], certs[0]
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return tls.Certificate{}, errors.New("pkcs12: no certificate for the private key")
+	}
+
+	cert := tls.Certificate{PrivateKey: key, Leaf: certs[0]}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+
+	return cert, nil
+}
+
 // Connect actually creates the TLS connection
 func (c *Conn) Connect() error {
 	// Make sure the existing connection is closed
@@ -60,14 +162,23 @@ func (c *Conn) Connect() error {
 		c.NetConn.Close()
 	}
 
-	conn, err := net.Dial("tcp", c.gateway)
+	conn, err := c.dial()
 	if err != nil {
 		return err
 	}
 
+	timeout := c.HandshakeTimeout
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
 	tlsConn := tls.Client(conn, c.Conf)
-	err = tlsConn.Handshake()
+	err = tlsConn.HandshakeContext(ctx)
 	if err != nil {
+		conn.Close()
 		return err
 	}
 
@@ -75,6 +186,37 @@ func (c *Conn) Connect() error {
 	return nil
 }
 
+func (c *Conn) dial() (net.Conn, error) {
+	network := c.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	d := c.Dialer
+	if d == nil {
+		d = &net.Dialer{KeepAlive: DefaultKeepAlive}
+	}
+
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	dial := d.DialContext
+	if c.DialContext != nil {
+		dial = c.DialContext
+	}
+
+	if c.Proxy != nil {
+		return dialProxy(ctx, c.Proxy, dial, network, c.gateway)
+	}
+
+	return dial(ctx, network, c.gateway)
+}
+
 func (c *Conn) Close() error {
 	if c.NetConn != nil {
 		return c.NetConn.Close()
@@ -2,7 +2,9 @@ package apns_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -63,6 +65,141 @@ scgnaBLBasLQ6GfKSRtcyidEi9wwxpVj0tw2p567jeNcIveD0TOYFf0RHEfrs+D4
 VdRgai/v2NbFZLDnzeGVuYypXu6R78isJfHtz/a0aEave8yB3CRiDw==
 -----END RSA PRIVATE KEY-----`
 
+// DummyCert and DummyKey bundled with an intermediate certificate, protected
+// with DummyP12Password
+var DummyP12, _ = base64.StdEncoding.DecodeString(`
+MIILaQIBAzCCCy8GCSqGSIb3DQEHAaCCCyAEggscMIILGDCCBc8GCSqGSIb3DQEH
+BqCCBcAwggW8AgEAMIIFtQYJKoZIhvcNAQcBMBwGCiqGSIb3DQEMAQMwDgQIpONW
+U0+9wakCAggAgIIFiM+PJcTyjch/GoYL/xsTB8UgltZ6hZJGICwu9/7Xqp8YnLCu
+6H7ZPEZuAz5l1sRnM7FcPC64hvyszCzGu+02qPXLoJEtCGpjfojJx7oGv7TKy3yX
+cHsAJUF1GXFwLaVWXAva1lytT0hzdWyoFBWH41IntL133ef/UZJVTTmfsL4h4uh9
+01SD/BJjoK8FBg47PUu4/pjszGyG+PYGJtwRPQ11lvee0ne1I5STzoU1CzgDXyy7
+wrbFnMqLShRhvtPdsXTMzs+aAx5wt1akefsCvYNBoEGqcYP7cS6gc5Ph4PeuLqhs
+K+K/TgJAen9VtchTn87DThC5PLZ5gth75yhGyZ5kXVN29rbjqOtmEAONtgPzj9rn
+Zo9SMQVtH9H7Wy3wolIqa53KB4LRw/U6ge6kmINJv6TPx9dAyym4+a9uuZCmHYoP
+DrW9uTvEOo4CREEjcuEKfkWx4HNtgUt7YmcnIeKBVIY6+giN0Pf4J/6Jsm1iXRbE
+2b2AuEAR7hh1HcAVyTtKLJj3xTGfRzMz82gvWbH6fxhEiX2xApGCKtNIeM0nDo5Q
+8knI5fhkWTLpsXN/fsdrknTXwoasHd4Vn2f3J70AXEgnMmpe5xK7UkGrEaQvNr/8
+PrK6O5s/MCHbwZdXnglLXYGgbo9vVHg3g33KZ7eisoN90NuvMA+J8NlmaVjEVcgf
+EFJuLbpbsbdJ2siZ4LzHHCIu2x0z5IvgNWsgSMEYlRYfDI9cpLHo4xwX66R0ltX3
+8ca+4UWP66WEqIQCsawaLXBf+t7ZYZ7y0qVYb+pnbTmPQBDu+viZTJd5nJXqcIBy
+xSpOaLa8JuVFVxNO+tZ1qo41WG49F4a10pqBgrYtZfJwCsV7V5gfFRGa1D2g4QO6
++Nh8p3hd7B9ECd3CtqqfdULfM6P33bMD3zTBER+XssOl4JTdV4YFwbpufSvbYhRe
+L5iKNgo3bLmXaMJKZcd8ECOQ72Uj8RFza4fEljxzGa/7kw3nZtiaEhXARRxO002u
+99tSaCWnBz2a21YJ8XiERyh+zVOSqdMUANt6WyL5+DpH8pDpXgHAL86mP1R4m5ew
+EZJ8M3pamMw4GRw/WQzw++mxJa0XRuvMHukkJp60pWsiRgIbahXvwskfCF4CUH3Z
+LVkzZ423FWaQQEta0MKVSp1frUBNBT6dxRFiy90w+v9NmMI61+LeunVbo+FS4UJK
+zMEAr+4X0AG/9tKxtTsspj+38xPuf353PBEhemGYVOLaZjZrTnUQsBum24BrAdSj
+OUzgapmZQEYGoBbH108dP7sZ6zu2sQwYc0TbhP1d5PcABmNhJzb+H2Zchau+/N8t
+hTgId1D0lrcxctX7pCrArWquwtxfeRM4bBo++mtw4tWB+sBb1z92phK0zwTEY29H
+DydW1XXcH/4qijWyoyL2NivtRfV/bcPuZexiWw4nKqDjagIjaoQ04ADMDEs+S9W/
+3oQSc7LvT2KHMmB+g71Ee8b96s4mtw4FMVqP1l7UuCN8oiiVjFHwF3JXj7/WaF25
+8BJUuo5qmPVvZVLRkG/MCdEuv+VTTVftrv/uXkuSJzLmOQOWhcNEPAs1Ovzx/q8A
+mdWMWE3nt56pM/ENgl5FYxdcJfGWed4eGLaR0TviUdNeIRwPqZ+Cjhjb+GCTYRHf
+wgzdp+vUVxO7c4f8g2FlyineRdzOx9RPgVa0SLpOHd62Ynh/4ydr+/dna3Ihk+jb
+tsGm/ql71JipeZXLtoJhNiJNVBpuVRMj7PbsECELPqcJlAGks8QoCB9VkO70Qrgy
+njsVvSOZiWU6ohyGORHHpVUrNMg4xbGazUfHp9Bj0ZMO8J9Rc0w/8+BBRTOokyik
+d/3jwVxMlOQRATvDyYIiiHWsmofQJtO2MJDzGP/idbfBkGF1DTCCBUEGCSqGSIb3
+DQEHAaCCBTIEggUuMIIFKjCCBSYGCyqGSIb3DQEMCgECoIIE7jCCBOowHAYKKoZI
+hvcNAQwBAzAOBAiqIqD1PY1SqAICCAAEggTIRno0AzJxuQY6UbBdZKt1geF3e37V
+MTnRqaRnzpwNlrHiWtUYEYNfc0HIArlw60/IAxzhPer8RFazls/U7cu0qhMNyeRW
+4wbQtNGIt1NJ7JtCQskbvbGe2AWYUJaVblbFgAvVI6C6v3/X7K9RpgutLiQcvK7m
+GJpvKDWMRRa26V4sttE+jrgAbNvAFRMkMe6JdXzviqvXE9c8Ez+TaC8eo4b3UD08
+xg1b3j91PTuTeti4yY5yvEKGa/LwBckQq2SsbCVI32VaL9ao4znXWEZGCojdrJUQ
+xyNTb18h0ETasyhR9DzHxHYAWIx+M541ApIXjZKlixaBZMmiVZ4E9yn932rgkZl4
+colJ+1yyFVwfcDuZteDuRNA9OK2VnyZ2rJ+bYeyFycSu9JGio5ATISXTqt8T8saC
+u9tEZinxMe7jLg7fJx/wz2z0BCS9fQ8R1Aqd2YNncB4+joj/dSkqaw4nor2RKzxX
+K8hJHd8d9uuQ61i/qbmrxD7Tin5UDu3Co4sZKQfQyUIsCCJ7In3DpqB/xQmlDhsh
+UEs5O0Fh/3BzYSNWX7Tz88qtseI3c0a1zzQUMn5XzFoGxGxUW4oxcdM/3h1e3FCv
+EZWN1t7zq7gfLFEEfoD6v5K6QxoGyXsqSQCEsq7O29z83LrGJxSNpfKDAJF9aXas
+QU6yEBegOSH9vZxi40IVDoTiAMjbBLgCQk+ur+5O70+kXTlD3ehff3GtW6j1kF0w
+SiyhFuJoiXzhMEdZe0P2EmpGBAXaXkkyjANdr0sdn2W/bHdSRIphM2l6XBCRE+9I
+VcqK4IpyqrQYtE5zV6yDa7cj49KsO3stbyDKhv4iplzlxf+KS9whX3MtdrnKEgie
+bRC7m5GsaMcsUyzMt98iZ5fdwiFx084RJHR6h9BWHRTUCr0yZF/F+BG+Jk4BYTXg
+fShxwIPb5bciO8fA0/D1U9W8gY9KxMX6xmRAccPPCL7UYFYjxidYvx0TJbbZVYt2
+J3iFSm5GFopKW1LUKHzdC7TMC9aIEed6RwpfaEkd36jO8Oho7Ncps+t0k1U8cNLT
+DIja+YJr09SSkDvn/GW+WVnC8Q7FgZXw50wZx3elj3DJD9LvDhSpdIEIXGHWCGKK
+J1xCLlW6FfOdg3NjvlpYODCnlA7Qxw5j19cRcG+8Hq36jGBtXOfGYisnuMwP6YTJ
+1F64zhyAWlNmEyxer9uISqDe+eSIDV/VHUl0yEWg40npcQ8mvAcu7qyv8SJSh7Ex
+MH/tpcpoJu+zNYDDZI96ESeri49Pz6AsboMdY2O+bOqyXliQFXMeE4zUqhlugVes
+q4UatJNiQ2FuhUuUUzSLWcSqDiNozrBby5VbBYhX/ueAtHbTnNEdvZNxOjvvAsbE
+Pf7kV8uym6/X21Og1yCxIpZCqv4DUJkix2pINdIvTFyKh1UJp075oq6mt+HONeln
+YnAr+JlBgZGCiFnY4v4E2Nh4fOtppxaeVWnkGlvlUGI0ONhxWYdjTAh3OryXb1jA
+oQgGPIxY0zXLtUm6NbGS4OtTArIdb6BATQsx7xJvyS1UtvDdmSBfjzPSsIMkc9Ei
+fz2Cz98Xd5ZE8/4SYJ8ht0JYxPnOiJOXQbSwblO1rpGTfQqA0AW4+VTQ/1VQfpJB
+bxV6MSUwIwYJKoZIhvcNAQkVMRYEFKbdFXA5RoZmrNXUZ7jQT65oGbX3MDEwITAJ
+BgUrDgMCGgUABBQAbarEsq8B2yTYWzhbrZF3ytDd7AQI4qhoitPcolwCAggA`)
+
+var DummyP12Password = "secret"
+
+// DummyP12 exported with OpenSSL 3 defaults: PBES2 with AES-256-CBC
+var DummyP12AES, _ = base64.StdEncoding.DecodeString(`
+MIIL/wIBAzCCC7UGCSqGSIb3DQEHAaCCC6YEgguiMIILnjCCBhIGCSqGSIb3DQEH
+BqCCBgMwggX/AgEAMIIF+AYJKoZIhvcNAQcBMFcGCSqGSIb3DQEFDTBKMCkGCSqG
+SIb3DQEFDDAcBAiIaBWFs1OTXwICCAAwDAYIKoZIhvcNAgkFADAdBglghkgBZQME
+ASoEEHLaYvWME4iE1xNZrKrBeSqAggWQiHqBcANb1oLUyZAkgoR75RJkJYL0YHd8
+Sb6YinywnhlS9Hze7RH98CJrwn1/KGEapMr886qrwuk2uvhoiz2by5Qfssj3WRBc
+bKAJEtKLJEzl9uDqcsmixyKp9MlklQSnK20CLzjJY9ozX7WyXWJGmEyeyWnLSS0z
+rd3cBEBU3Z1RFuIItlYGfWyUIjfA7LEhUoazmwRvM4Rh/DDhPrrtyV7X6j+RD6CE
+eeTWIgDrlf/xiIeVMCEjeODsixw+GBkSYQaMHkBDhmtlrEt7F4BD2bbZNDOwbLyh
+4lrEtWDBmozcjwwV/zQXxharxZ8uqzsI+zjf0THgMnKk4zjbh3blvjuHhWBef6Yp
+/QiBnu/MnULCEI9yRw/lhDyDXRBXTRm0e+ayj6rKrrtQDlOKe6UiQo1ygu6gkXIz
+M0dxQ76n1nGUZr+jTsZuNultyH6Kp9Df3jIFRlo/SCe5ouUuICxRmvCbytp20WtV
+iTFsxgGQ5UkSXjoh2N8igQNT9lakO2QxOK6+lNNBbEPhoTo3+fY4JYNdVhYSK+tv
+s3uJL+jmwGkyspJivzL4yAHIT1ixJ0cw+RTmBCKI11QI7bn1OXOA5RKzKozwPYmi
+rdXzLQhQy+XlKOeH3ROUaXD3ayr18M/BEAF0YHnegCW2Tv7WCiQ0ttOm0EqiTd/M
+tzaHfRXAFIBeJbFoFzGQ2CzT4COlCnzjbgK5zdzyVFzSXcIy/e5kxiK+abVIciS8
+bL2lLmuAM76QGlpwLXuD0ElFpKJOKIq+Yihlc75e+nCwoz8VVxx3inWZdK7Q6Zxj
+/6ODx/S/K5qTnZdK+usGShF8DKaSP5TSTy1/XMEG2mxnFsyX0xsVz5UYonyyTtB8
+ROgwkgK3NYyfqpYdq8vcN1W0sv6GyUU/ih9GRab/v4rq1lt2DQvSa8jIRIb37CA3
+xepiThbWbjNHR0XPRr/oCI5Sun6U+XF8CTHlhCDxk7dOlnv9FrKNm3s/sASYYTRG
+TERgzKW8aS5fN7Rd+4RS4joJGMW0YzTierJfY7bvz4dieFHM0WV5Du2MmDqJqR1P
+uA4SxG8HEZfa57wnVY4WlrrB61QIMU/Y8RR6sSYCZ9TLCuOaTf6FV3NsZbLLbBWl
+JoQfu6acsDb/hyAE43XGiQlACam/IkCS8sE6iQhxlM7OYuHl+kYA4Z2DL+cn7sfv
+LTMb8KBrf7/2UJ6oHO0jKULAq8v5SVgaYhawJ/9+T41YKbu/oMLF9T1vffsDQCcT
+R++xumd5lq9DHTttDHcf50X+wvYM0kcaAICxmxi0SIFjX2aZ+doEEX8+CrNDG8kh
+MeyYn7PH9DvuupDNLY2gErB0+jfSxI70njdgfarao33M0148Ql4bYjjKR4YiTK+y
+DfATgFCD/JkKXkSkqegnB/3mJ3RQq7iwzHibJsIgcY7M35mE5ugv7hxEN+7l+vdz
+pu4JkpktpDV1N9ELM5KEerNmHsSO57g2dK7/Rrp0vHar/ntVLpbeWFlAoR/Ua/6G
+iMWiVuUl07/+8xH5Xyd75CeOuBwFfbF6hyP9hbePmULnu8NpSHQSbxOFVsTDShKY
+NmiQnhMaxpcDrASvPo+hy5qkPbUE8DSomwEEorsXg27BUhaEhO2EmUkJIdc6yBbW
+cZfoilX7ptio22tZO+NsYQmU8xNzJCFn1xo1LZUPjW6MZGcXRuU9PmpR5rzioZrD
++QmjejvDVz3mniAkjG4oRG8xhWNgiX/YcT9EUFsIbe4ilcL2X3fgAS/hRYGax4Tk
+GUrIwuFySF4qcAJZji0F8HKYpxHT/KFXK9lPSiYMaSrsdO5dt/yMtmZfNxoIUMwZ
+Tv6JsqOU4kjCzS2Y/5IDbskkUu0KmV0+7CUJn7DghlucL2Vi2RHH6xVyvIG66k58
+RdYbEnefL84wggWEBgkqhkiG9w0BBwGgggV1BIIFcTCCBW0wggVpBgsqhkiG9w0B
+DAoBAqCCBTEwggUtMFcGCSqGSIb3DQEFDTBKMCkGCSqGSIb3DQEFDDAcBAgwYogP
+llHWZwICCAAwDAYIKoZIhvcNAgkFADAdBglghkgBZQMEASoEEFbjRUNfTAyxQswS
+pkkxxTMEggTQte5MNMpyOQfYQj2GlB7vEEfqdexJSDvpEQvFSSb8FZ2NTm8AYU1R
+QzPoSubPfqOCv6Xxn/P2JO+7TsaMBrjGYsNXPAuNmvNT6AcmvJ+3slKmtULw6JA3
+/cvde1pYjP9OzrYpaoNRbZ2n0PWrgjPR87h0pv0CHuiKmdHdDrlfkmNYRkomH7gg
+LCdg9T9IJ8Qma5qT5CMJS8aJ8GCxtpFKUAfKn0obhoy5OKb0eRioJLPCEt5/quo8
+p9C0xpFCiFEwPy2D/zewY1lCPkRyvKrFGu6MA7EOZu3JBVhrH0ZNEXlVsnf1JgsH
+qxk0NYaBfO5/2wEB3h/fDSzw38FA8Ffl6U+tnFx0d37sLkkhBf2lOO7bDh8Wn6p5
+XUZoCnxU8a8urmE2o/Ub9QdResA1maB9TPg5l5ejQLOOtfJbkqmAXybWY8P7tp0x
+2ex+p7RzdW8kjJtFeDsr42SHOeCxBwj9zKTT1BLsYiG3eHZmApX05eb4hv3QPHBD
+F2a0Cug2DrAm3FFKfKwZBehpGWzkDE02waHdMMfgr9t354Scef4BQ5778z6iSQB+
+9jOJmm+WHoougAtqYnnomxvO9W++RB7yjUGjXpvoh8o2O05dpLqDwMP7s6inGEOU
+tjZcPaNTT2eVlXZxxW8iI61fWfKr2K0hLkoZe+cobz0vsjjfQbJlDpoDJYDz8zDk
+Xg1nXoJokZNKfBtkDKMb8BXeeo3HzGroLUiIjLuujxGwZZAXBs6r93bndJoqF2zZ
+dlqTcToqF6xBPJ7ilZ9TIy2k0KBLrUndzBqX5/GpHLYus2lKBPMrJH/PQv3a0/NT
+mW0NaF+/rL3dTj5YpZEpwNrLauXvr/Pg6NeYx833yQ7nD314SjloGxyMApOadRoz
+TqMremgC1CXcg4IKRBQkhigH4pPtmLgUnOzO1qkA7XFx6Yj3RGMdmZAhE0YNc9Td
+Rn5ran/W6olYFVWGxH4kY8qWS/9Mp9UWyva7rabMd+4Vep8fCZZNVbzFjhZesn1s
+O/iEz0owQLEzof6gzzk1CvdFZxStZ5zF9y1FnreqZgRfNzJHLfM/jTMt6I+E7N6F
+zsGT/PUaSPBFOHtOtNQzHlWkqgx7w6qjFSbPgSVYClbHlnBV5qsCF75VykUQ1wlI
+DQE8vrvLHvd+NmhmImE4AsLnFE9Iqgiei4P67jmptNae8IZ+Xb3RnIEVoQttJkIh
++Zh1lpqJABJL1wa2jhS+UdVU5c6rqCX2VoslkdEVNZRzC/U6AGpm0ksM32k2MIrn
+2Z6gCUcHEk3/TOUwq3FSt5aCbRUFHb/m6KpRumTlpx5CGW+0cJh/zpsVVqVpf/FJ
+uYqI/VUGA+2jqf6tpb9DB9npT20pIEYZJ0J6UeOBe2bYgdZj72Q39ODnZa+pJXEt
+GFUlTOcZodY82UvYW1YEX6SEFObRyTFvD8avI4lIZrXXEcJmYnsS+VHBM7I+aL6U
+4B9VnjtzDnSVlWZS1iFVAx/Sn+ZLy3DyKieWMpKiCydpBxRhL4hyq1foznJplAQy
+xiAcxTaQVcuSN6suMJU9WWDlysmcO6nLguHgV9AKJ+2OEwmX+3YKC8/dfvoiafhR
+BTqkxBGWFbesjFAbU3LbTwxi1EYjUJgYWcakD8Me+WZZ3EgihY/mH98xJTAjBgkq
+hkiG9w0BCRUxFgQUpt0VcDlGhmas1dRnuNBPrmgZtfcwQTAxMA0GCWCGSAFlAwQC
+AQUABCBJDgheXPfAKpaA71vgzBCcotTxegaA3yUFfx/Pumqr5wQITvj7uYzwRScC
+AggA`)
+
 // To be able to run in parallel
 var mockPort = 50000
 
@@ -156,7 +293,19 @@ func (m *mockTLSServer) start() {
 
 	config := tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAnyClientCert}
 
-	m.Server, err = tls.Listen("tcp", "localhost:"+m.portStr(), &config)
+	// The mock ports can be taken by other sockets, so move on to the next
+	for tries := 0; ; tries++ {
+		m.Server, err = tls.Listen("tcp", "localhost:"+m.portStr(), &config)
+		if err == nil {
+			break
+		}
+		if tries == 100 {
+			log.Panic(err)
+		}
+
+		m.Port = 0
+	}
+
 	go func() {
 		for i := 0; i < len(m.ConnectionActionGroups); i++ {
 			g := m.ConnectionActionGroups[i]
@@ -284,6 +433,76 @@ var _ = Describe("Conn", func() {
 		})
 	})
 
+	Describe(".NewConnWithP12", func() {
+		Context("bad password", func() {
+			It("should return an error", func() {
+				_, err := apns.NewConnWithP12(apns.SandboxGateway, DummyP12, "wrong")
+				Expect(err).NotTo(BeNil())
+			})
+		})
+
+		Context("not a p12 bundle", func() {
+			It("should return an error", func() {
+				_, err := apns.NewConnWithP12(apns.SandboxGateway, []byte(DummyCert), DummyP12Password)
+				Expect(err).NotTo(BeNil())
+			})
+		})
+
+		Context("AES encrypted bundle", func() {
+			It("should load the key and the whole chain", func() {
+				conn, err := apns.NewConnWithP12(apns.SandboxGateway, DummyP12AES, DummyP12Password)
+				Expect(err).To(BeNil())
+
+				cert := conn.Conf.Certificates[0]
+				Expect(cert.Certificate).To(HaveLen(2))
+				Expect(cert.PrivateKey).NotTo(BeNil())
+				Expect(cert.Leaf.Subject.Organization).To(Equal([]string{"Acme Co"}))
+			})
+		})
+
+		Context("valid bundle", func() {
+			It("should load the key and the whole chain", func() {
+				conn, err := apns.NewConnWithP12(apns.SandboxGateway, DummyP12, DummyP12Password)
+				Expect(err).To(BeNil())
+
+				cert := conn.Conf.Certificates[0]
+				Expect(cert.Certificate).To(HaveLen(2))
+				Expect(cert.PrivateKey).NotTo(BeNil())
+				Expect(cert.Leaf.Subject.Organization).To(Equal([]string{"Acme Co"}))
+			})
+		})
+	})
+
+	Describe(".NewConnWithP12File", func() {
+		Context("missing file", func() {
+			It("should return an error", func() {
+				_, err := apns.NewConnWithP12File(apns.SandboxGateway, "missing.p12", DummyP12Password)
+				Expect(err).NotTo(BeNil())
+			})
+		})
+
+		Context("valid bundle", func() {
+			var p12File *os.File
+
+			BeforeEach(func() {
+				p12File, _ = ioutil.TempFile("", "cert.p12")
+				p12File.Write(DummyP12)
+				p12File.Close()
+			})
+
+			AfterEach(func() {
+				if p12File != nil {
+					os.Remove(p12File.Name())
+				}
+			})
+
+			It("should return a connection", func() {
+				_, err := apns.NewConnWithP12File(apns.SandboxGateway, p12File.Name(), DummyP12Password)
+				Expect(err).To(BeNil())
+			})
+		})
+	})
+
 	Describe("#Connect()", func() {
 		Context("server not up", func() {
 			conn, _ := apns.NewConnWithFiles(apns.SandboxGateway, "missing.pem", "missing.pem")
@@ -346,6 +565,80 @@ var _ = Describe("Conn", func() {
 		})
 	})
 
+	Describe("#Connect() dialing", func() {
+		as := [][]serverAction{[]serverAction{serverAction{action: readAction, data: []byte{}}}}
+
+		Context("with a DialContext", func() {
+			It("should dial through it", func(d Done) {
+				withMockServer(as, func(s *mockTLSServer) {
+					conn, _ := apns.NewConn(s.Address(), DummyCert, DummyKey)
+					conn.Conf.InsecureSkipVerify = true
+					conn.Network = "tcp4"
+
+					var network, addr string
+					conn.DialContext = func(ctx context.Context, n, a string) (net.Conn, error) {
+						network, addr = n, a
+
+						_, hasDeadline := ctx.Deadline()
+						Expect(hasDeadline).To(BeTrue())
+
+						return (&net.Dialer{}).DialContext(ctx, n, a)
+					}
+
+					Expect(conn.Connect()).To(BeNil())
+					Expect(network).To(Equal("tcp4"))
+					Expect(addr).To(Equal(s.Address()))
+
+					close(d)
+				})
+			})
+		})
+
+		Context("dial timing out", func() {
+			It("should return an error", func(d Done) {
+				conn, _ := apns.NewConn(apns.SandboxGateway, DummyCert, DummyKey)
+				conn.Dialer = &net.Dialer{Timeout: 50 * time.Millisecond}
+				conn.DialContext = func(ctx context.Context, n, a string) (net.Conn, error) {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+
+				Expect(conn.Connect()).To(Equal(context.DeadlineExceeded))
+				close(d)
+			})
+		})
+
+		Context("server never completing the handshake", func() {
+			var l net.Listener
+
+			BeforeEach(func() {
+				l, _ = net.Listen("tcp", "localhost:0")
+				go func() {
+					c, err := l.Accept()
+					if err == nil {
+						defer c.Close()
+						time.Sleep(time.Second)
+					}
+				}()
+			})
+
+			AfterEach(func() {
+				l.Close()
+			})
+
+			It("should time out", func(d Done) {
+				conn, _ := apns.NewConn(l.Addr().String(), DummyCert, DummyKey)
+				conn.HandshakeTimeout = 50 * time.Millisecond
+
+				start := time.Now()
+				Expect(conn.Connect()).NotTo(BeNil())
+				Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+
+				close(d)
+			})
+		})
+	})
+
 	Describe("#Read", func() {
 		rwc := mockTLSNetConn{bb: bytes.NewBuffer([]byte("hello!"))}
 
@@ -0,0 +1,101 @@
+package apns
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDuplicate is returned by Client.Send for notifications its Deduplicator
+// has already seen
+var ErrDuplicate = errors.New("duplicate notification")
+
+// Deduplicator recognizes notifications sent more than once within TTL, e.g.
+// by upstream retries. Notifications are identified by their ID, or by their
+// device token and payload when they don't have one.
+type Deduplicator struct {
+	TTL time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+	dropped   uint64
+}
+
+func NewDeduplicator(ttl time.Duration) *Deduplicator {
+	return &Deduplicator{TTL: ttl, seen: map[string]time.Time{}}
+}
+
+func dedupeKey(n Notification) string {
+	if n.ID != "" {
+		return "id:" + n.ID
+	}
+
+	j, _ := n.payloadJSON()
+
+	h := sha256.New()
+	h.Write([]byte(n.DeviceToken))
+	h.Write([]byte{0})
+	h.Write(j)
+
+	return "hash:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Seen records n, and reports whether it's a duplicate of a notification
+// recorded within TTL. Duplicates are counted in Dropped.
+func (d *Deduplicator) Seen(n Notification) bool {
+	key := dedupeKey(n)
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.seen == nil {
+		d.seen = map[string]time.Time{}
+	}
+
+	d.sweep(now)
+
+	if t, ok := d.seen[key]; ok && now.Sub(t) < d.TTL {
+		d.dropped++
+		return true
+	}
+
+	d.seen[key] = now
+	return false
+}
+
+// forget removes n, so it's not a duplicate when it's sent again
+func (d *Deduplicator) forget(n Notification) {
+	key := dedupeKey(n)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.seen, key)
+}
+
+// sweep forgets expired notifications, at most once per TTL
+func (d *Deduplicator) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.TTL {
+		return
+	}
+
+	for key, t := range d.seen {
+		if now.Sub(t) >= d.TTL {
+			delete(d.seen, key)
+		}
+	}
+
+	d.lastSweep = now
+}
+
+// Dropped returns the number of duplicates seen
+func (d *Deduplicator) Dropped() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.dropped
+}
@@ -0,0 +1,59 @@
+package apns_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+var _ = Describe("Deduplicator", func() {
+	t1 := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+	t2 := "00a1a4b7294fcfbc5293f63d4298fcecd9c20a893befd45adceead5fc92d3319"
+
+	Describe("#Seen", func() {
+		Context("same ID", func() {
+			It("should be a duplicate", func() {
+				d := apns.NewDeduplicator(time.Minute)
+
+				Expect(d.Seen(apns.Notification{ID: "a", DeviceToken: t1})).To(BeFalse())
+				Expect(d.Seen(apns.Notification{ID: "a", DeviceToken: t2})).To(BeTrue())
+				Expect(d.Seen(apns.Notification{ID: "b", DeviceToken: t1})).To(BeFalse())
+				Expect(d.Dropped()).To(Equal(uint64(1)))
+			})
+		})
+
+		Context("no ID", func() {
+			It("should compare the token and payload", func() {
+				d := apns.NewDeduplicator(time.Minute)
+
+				p1 := apns.NewPayload()
+				p1.APS.Alert.Body = "hi"
+
+				p2 := apns.NewPayload()
+				p2.APS.Alert.Body = "hi"
+
+				p3 := apns.NewPayload()
+				p3.APS.Alert.Body = "bye"
+
+				Expect(d.Seen(apns.Notification{DeviceToken: t1, Payload: p1})).To(BeFalse())
+				Expect(d.Seen(apns.Notification{DeviceToken: t1, Payload: p2})).To(BeTrue())
+				Expect(d.Seen(apns.Notification{DeviceToken: t2, Payload: p2})).To(BeFalse())
+				Expect(d.Seen(apns.Notification{DeviceToken: t1, Payload: p3})).To(BeFalse())
+			})
+		})
+
+		Context("after the TTL", func() {
+			It("should not be a duplicate", func() {
+				d := apns.NewDeduplicator(20 * time.Millisecond)
+
+				Expect(d.Seen(apns.Notification{ID: "a"})).To(BeFalse())
+
+				time.Sleep(30 * time.Millisecond)
+				Expect(d.Seen(apns.Notification{ID: "a"})).To(BeFalse())
+				Expect(d.Seen(apns.Notification{ID: "a"})).To(BeTrue())
+			})
+		})
+	})
+})
@@ -0,0 +1,119 @@
+package apns
+
+import "time"
+
+// SendFilter inspects notifications passed to Client.Send before they're
+// queued
+type SendFilter interface {
+	// FilterSend may modify n. It returns a later time to send n at, or the
+	// zero time to send it right away. Returning an error rejects n.
+	FilterSend(n *Notification, now time.Time) (time.Time, error)
+}
+
+// DeliveryWindow is a SendFilter keeping notifications to the hours of the
+// day a device's user is awake. Notifications outside the window are
+// deferred until it opens, or downgraded.
+type DeliveryWindow struct {
+	// Start and End are the hours (0-23) of the device's local time during
+	// which notifications are delivered. A window ending before it starts
+	// spans midnight. A window ending when it starts is always open.
+	Start int
+	End   int
+
+	// Location returns the device's time zone. UTC is used when it's nil
+	// or returns nil.
+	Location func(token string) *time.Location
+
+	// Downgrade sends notifications outside the window right away, with
+	// PriorityPowerConserve and no sound, instead of deferring them
+	Downgrade bool
+
+	// Notifications with these priorities or categories, e.g. transactional
+	// ones, are always sent right away
+	ExemptPriorities []int
+	ExemptCategories []string
+}
+
+func (w DeliveryWindow) location(token string) *time.Location {
+	if w.Location == nil {
+		return time.UTC
+	}
+
+	if loc := w.Location(token); loc != nil {
+		return loc
+	}
+
+	return time.UTC
+}
+
+// Open reports whether t is inside the window for a device in loc
+func (w DeliveryWindow) Open(t time.Time, loc *time.Location) bool {
+	h := t.In(loc).Hour()
+
+	switch {
+	case w.Start < w.End:
+		return h >= w.Start && h < w.End
+	case w.Start > w.End:
+		return h >= w.Start || h < w.End
+	}
+
+	return true
+}
+
+// NextOpen returns when the window next opens after t for a device in loc,
+// or t if it's open
+func (w DeliveryWindow) NextOpen(t time.Time, loc *time.Location) time.Time {
+	if w.Open(t, loc) {
+		return t
+	}
+
+	lt := t.In(loc)
+	next := time.Date(lt.Year(), lt.Month(), lt.Day(), w.Start, 0, 0, 0, loc)
+	if !next.After(lt) {
+		next = time.Date(lt.Year(), lt.Month(), lt.Day()+1, w.Start, 0, 0, 0, loc)
+	}
+
+	return next
+}
+
+func (w DeliveryWindow) exempt(n *Notification) bool {
+	for _, p := range w.ExemptPriorities {
+		if n.Priority == p {
+			return true
+		}
+	}
+
+	if n.Payload == nil {
+		return false
+	}
+
+	for _, c := range w.ExemptCategories {
+		if n.Payload.APS.Category == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w DeliveryWindow) FilterSend(n *Notification, now time.Time) (time.Time, error) {
+	loc := w.location(n.DeviceToken)
+	if w.exempt(n) || w.Open(now, loc) {
+		return time.Time{}, nil
+	}
+
+	if !w.Downgrade {
+		return w.NextOpen(now, loc), nil
+	}
+
+	n.Priority = PriorityPowerConserve
+
+	// The payload may be shared with other notifications
+	if n.Payload != nil && n.Payload.APS.Sound != "" {
+		p := *n.Payload
+		p.APS.Sound = ""
+		n.Payload = &p
+	}
+
+	return time.Time{}, nil
+}
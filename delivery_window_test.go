@@ -0,0 +1,135 @@
+package apns_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+type rejectFilter struct{}
+
+func (f rejectFilter) FilterSend(n *apns.Notification, now time.Time) (time.Time, error) {
+	return time.Time{}, errors.New("rejected")
+}
+
+var _ = Describe("DeliveryWindow", func() {
+	tok := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+	ny, _ := time.LoadLocation("America/New_York")
+
+	daytime := apns.DeliveryWindow{Start: 8, End: 21}
+	overnight := apns.DeliveryWindow{Start: 22, End: 6}
+
+	Describe("#Open", func() {
+		It("should follow the device's local time", func() {
+			// 3am in New York
+			t := time.Date(2014, 7, 1, 7, 0, 0, 0, time.UTC)
+
+			Expect(daytime.Open(t, time.UTC)).To(BeFalse())
+			Expect(daytime.Open(t, ny)).To(BeFalse())
+			Expect(daytime.Open(t.Add(6*time.Hour), ny)).To(BeTrue())
+		})
+
+		It("should handle windows spanning midnight", func() {
+			Expect(overnight.Open(time.Date(2014, 7, 1, 23, 0, 0, 0, time.UTC), time.UTC)).To(BeTrue())
+			Expect(overnight.Open(time.Date(2014, 7, 1, 5, 0, 0, 0, time.UTC), time.UTC)).To(BeTrue())
+			Expect(overnight.Open(time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC), time.UTC)).To(BeFalse())
+		})
+	})
+
+	Describe("#NextOpen", func() {
+		It("should return the next opening", func() {
+			early := time.Date(2014, 7, 1, 3, 0, 0, 0, ny)
+			late := time.Date(2014, 7, 1, 22, 0, 0, 0, ny)
+
+			Expect(daytime.NextOpen(early, ny)).To(Equal(time.Date(2014, 7, 1, 8, 0, 0, 0, ny)))
+			Expect(daytime.NextOpen(late, ny)).To(Equal(time.Date(2014, 7, 2, 8, 0, 0, 0, ny)))
+			Expect(overnight.NextOpen(time.Date(2014, 7, 1, 12, 0, 0, 0, ny), ny)).To(Equal(time.Date(2014, 7, 1, 22, 0, 0, 0, ny)))
+		})
+	})
+
+	Describe("#FilterSend", func() {
+		night := time.Date(2014, 7, 1, 7, 0, 0, 0, time.UTC)
+
+		Context("outside the window", func() {
+			It("should defer to the next opening", func() {
+				w := daytime
+				w.Location = func(string) *time.Location { return ny }
+
+				n := apns.Notification{DeviceToken: tok}
+				at, err := w.FilterSend(&n, night)
+
+				Expect(err).To(BeNil())
+				Expect(at).To(Equal(time.Date(2014, 7, 1, 8, 0, 0, 0, ny)))
+			})
+		})
+
+		Context("downgrading", func() {
+			It("should send quietly right away", func() {
+				w := daytime
+				w.Location = func(string) *time.Location { return ny }
+				w.Downgrade = true
+
+				p := apns.NewPayload()
+				p.APS.Sound = "default"
+
+				n := apns.Notification{DeviceToken: tok, Priority: apns.PriorityImmediate, Payload: p}
+				at, err := w.FilterSend(&n, night)
+
+				Expect(err).To(BeNil())
+				Expect(at.IsZero()).To(BeTrue())
+				Expect(n.Priority).To(Equal(apns.PriorityPowerConserve))
+				Expect(n.Payload.APS.Sound).To(Equal(""))
+
+				// The shared payload is left alone
+				Expect(p.APS.Sound).To(Equal("default"))
+			})
+		})
+
+		Context("exempt notifications", func() {
+			It("should send right away", func() {
+				w := daytime
+				w.Location = func(string) *time.Location { return ny }
+				w.ExemptPriorities = []int{apns.PriorityImmediate}
+				w.ExemptCategories = []string{"receipt"}
+
+				n := apns.Notification{DeviceToken: tok, Priority: apns.PriorityImmediate}
+				at, _ := w.FilterSend(&n, night)
+				Expect(at.IsZero()).To(BeTrue())
+
+				p := apns.NewPayload()
+				p.APS.Category = "receipt"
+
+				n = apns.Notification{DeviceToken: tok, Payload: p}
+				at, _ = w.FilterSend(&n, night)
+				Expect(at.IsZero()).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("Client filters", func() {
+		Context("rejected by a filter", func() {
+			It("should return the error", func() {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+				c.Filters = []apns.SendFilter{rejectFilter{}}
+
+				Expect(c.Send(apns.Notification{DeviceToken: tok})).NotTo(BeNil())
+			})
+		})
+
+		Context("deferred by a filter", func() {
+			It("should hold on to the notification", func(d Done) {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+
+				// Opens in a couple of hours
+				h := time.Now().UTC().Hour()
+				c.Filters = []apns.SendFilter{apns.DeliveryWindow{Start: (h + 2) % 24, End: (h + 3) % 24}}
+
+				Expect(c.Send(apns.Notification{DeviceToken: tok})).To(BeNil())
+				close(d)
+			})
+		})
+	})
+})
@@ -0,0 +1,271 @@
+package apns
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+const hexDigits = "0123456789abcdef"
+
+// sharedPayload is a payload marshalled once for many notifications
+type sharedPayload struct {
+	p    *Payload
+	json []byte
+}
+
+// sharedJSON returns n's payload marshalled by Client.Multicast, or nil if
+// there's none or Payload has been replaced since, e.g. by a SendFilter
+func (n *Notification) sharedJSON() []byte {
+	if n.shared == nil || n.shared.p != n.Payload {
+		return nil
+	}
+
+	return n.shared.json
+}
+
+// payloadJSON returns n's payload marshalled, which mustn't be modified
+func (n *Notification) payloadJSON() ([]byte, error) {
+	if j := n.sharedJSON(); j != nil {
+		return j, nil
+	}
+
+	return n.Payload.appendJSON(nil)
+}
+
+// appendJSON appends p as JSON: "aps" (or "mdm") first, then the custom
+// values sorted by key. Strings are escaped like encoding/json does.
+func (p *Payload) appendJSON(dst []byte) ([]byte, error) {
+	if p == nil {
+		return append(dst, "null"...), nil
+	}
+
+	dst = append(dst, '{')
+	if len(p.MDM) != 0 {
+		dst = append(dst, `"mdm":`...)
+		dst = appendJSONString(dst, p.MDM)
+	} else {
+		dst = append(dst, `"aps":`...)
+		dst = p.APS.appendJSON(dst)
+	}
+
+	keys := make([]string, 0, len(p.customValues))
+	for k := range p.customValues {
+		if k != "aps" && (k != "mdm" || len(p.MDM) == 0) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		j, err := json.Marshal(p.customValues[k])
+		if err != nil {
+			return dst, err
+		}
+
+		dst = append(dst, ',')
+		dst = appendJSONString(dst, k)
+		dst = append(dst, ':')
+		dst = append(dst, j...)
+	}
+
+	return append(dst, '}'), nil
+}
+
+func (aps *APS) appendJSON(dst []byte) []byte {
+	dst = append(dst, '{')
+	start := len(dst)
+
+	field := func(name string) {
+		if len(dst) > start {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, '"')
+		dst = append(dst, name...)
+		dst = append(dst, '"', ':')
+	}
+
+	if aps.AccountId != "" {
+		field("account-id")
+		dst = appendJSONString(dst, aps.AccountId)
+	}
+	if !aps.Alert.isZero() {
+		field("alert")
+		if aps.Alert.isSimple() {
+			dst = appendJSONString(dst, aps.Alert.Body)
+		} else {
+			dst = aps.Alert.appendJSON(dst)
+		}
+	}
+	if aps.Badge.IsSet {
+		field("badge")
+		dst = strconv.AppendUint(dst, uint64(aps.Badge.Number), 10)
+	}
+	if aps.Category != "" {
+		field("category")
+		dst = appendJSONString(dst, aps.Category)
+	}
+	if aps.ContentAvailable != 0 {
+		field("content-available")
+		dst = strconv.AppendInt(dst, int64(aps.ContentAvailable), 10)
+	}
+	if aps.Sound != "" {
+		field("sound")
+		dst = appendJSONString(dst, aps.Sound)
+	}
+	if len(aps.URLArgs) != 0 {
+		field("url-args")
+		dst = appendJSONStrings(dst, aps.URLArgs)
+	}
+
+	return append(dst, '}')
+}
+
+// appendJSON follows the field order and omitempty tags of Alert
+func (a *Alert) appendJSON(dst []byte) []byte {
+	dst = append(dst, '{')
+	start := len(dst)
+
+	str := func(name, v string) {
+		if v == "" {
+			return
+		}
+		if len(dst) > start {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, '"')
+		dst = append(dst, name...)
+		dst = append(dst, '"', ':')
+		dst = appendJSONString(dst, v)
+	}
+
+	str("body", a.Body)
+	str("title", a.Title)
+	str("action", a.Action)
+	str("loc-key", a.LocKey)
+	if len(a.LocArgs) != 0 {
+		if len(dst) > start {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, `"loc-args":`...)
+		dst = appendJSONStrings(dst, a.LocArgs)
+	}
+	str("action-loc-key", a.ActionLocKey)
+	str("launch-image", a.LaunchImage)
+
+	return append(dst, '}')
+}
+
+func appendJSONStrings(dst []byte, ss []string) []byte {
+	dst = append(dst, '[')
+	for i, s := range ss {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJSONString(dst, s)
+	}
+
+	return append(dst, ']')
+}
+
+// appendJSONString escapes s like encoding/json, including its HTML escaping
+// and replacing invalid UTF-8
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+
+		// U+2028 and U+2029 break JavaScript string literals
+		if r == '\u2028' || r == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+
+		i += size
+	}
+
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
+
+// appendToken appends the 32 bytes of a hex device token
+func appendToken(dst []byte, tok string) ([]byte, error) {
+	if len(tok) != 2*deviceTokenItemLength {
+		return dst, tokenError(tok)
+	}
+
+	for i := 0; i < len(tok); i += 2 {
+		hi, ok1 := fromHexChar(tok[i])
+		lo, ok2 := fromHexChar(tok[i+1])
+		if !ok1 || !ok2 {
+			return dst, tokenError(tok)
+		}
+		dst = append(dst, hi<<4|lo)
+	}
+
+	return dst, nil
+}
+
+func tokenError(tok string) error {
+	if _, err := hex.DecodeString(tok); err != nil {
+		return fmt.Errorf("convert token to hex error: %s", err)
+	}
+
+	return ErrBadDeviceToken
+}
+
+func fromHexChar(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,335 @@
+package apns_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+// payloadCase builds a payload from its APS (or MDM) and custom values, which
+// are kept so referenceJSON can marshal them without Payload's help
+type payloadCase struct {
+	aps    func(p *apns.Payload)
+	custom map[string]interface{}
+}
+
+func (c payloadCase) payload() *apns.Payload {
+	p := apns.NewPayload()
+	if c.aps != nil {
+		c.aps(p)
+	}
+	for k, v := range c.custom {
+		p.SetCustomValue(k, v)
+	}
+
+	return p
+}
+
+// referenceJSON marshals c the way payloads were before appendJSON, with maps
+// and encoding/json, but with "aps" (or "mdm") moved first
+func referenceJSON(c payloadCase) []byte {
+	p := c.payload()
+
+	var j []byte
+	if p.MDM != "" {
+		m, _ := json.Marshal(p.MDM)
+		j = append([]byte(`{"mdm":`), m...)
+	} else {
+		aps := map[string]interface{}{}
+		if p.APS.Alert.Body != "" && p.APS.Alert.Title == "" && p.APS.Alert.Action == "" &&
+			p.APS.Alert.LocKey == "" && len(p.APS.Alert.LocArgs) == 0 &&
+			p.APS.Alert.ActionLocKey == "" && p.APS.Alert.LaunchImage == "" {
+			aps["alert"] = p.APS.Alert.Body
+		} else if !reflect.DeepEqual(p.APS.Alert, apns.Alert{}) {
+			aps["alert"] = p.APS.Alert
+		}
+		if p.APS.Badge.IsSet {
+			aps["badge"] = p.APS.Badge.Number
+		}
+		if p.APS.Sound != "" {
+			aps["sound"] = p.APS.Sound
+		}
+		if p.APS.ContentAvailable != 0 {
+			aps["content-available"] = p.APS.ContentAvailable
+		}
+		if p.APS.Category != "" {
+			aps["category"] = p.APS.Category
+		}
+		if len(p.APS.URLArgs) != 0 {
+			aps["url-args"] = p.APS.URLArgs
+		}
+		if p.APS.AccountId != "" {
+			aps["account-id"] = p.APS.AccountId
+		}
+
+		m, _ := json.Marshal(aps)
+		j = append([]byte(`{"aps":`), m...)
+	}
+
+	keys := make([]string, 0, len(c.custom))
+	for k := range c.custom {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		kj, _ := json.Marshal(k)
+		vj, _ := json.Marshal(c.custom[k])
+		j = append(j, ',')
+		j = append(j, kj...)
+		j = append(j, ':')
+		j = append(j, vj...)
+	}
+
+	return append(j, '}')
+}
+
+// legacyToBinary is how frames were encoded before AppendBinary, with
+// binary.Write
+func legacyToBinary(n apns.Notification, payload []byte) []byte {
+	tok, _ := hex.DecodeString(n.DeviceToken)
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint8(1))
+	binary.Write(buf, binary.BigEndian, uint16(len(tok)))
+	buf.Write(tok)
+	binary.Write(buf, binary.BigEndian, uint8(2))
+	binary.Write(buf, binary.BigEndian, uint16(len(payload)))
+	buf.Write(payload)
+	binary.Write(buf, binary.BigEndian, uint8(3))
+	binary.Write(buf, binary.BigEndian, uint16(4))
+	binary.Write(buf, binary.BigEndian, n.Identifier)
+	binary.Write(buf, binary.BigEndian, uint8(4))
+	binary.Write(buf, binary.BigEndian, uint16(4))
+	if n.Expiration == nil {
+		binary.Write(buf, binary.BigEndian, uint32(0))
+	} else {
+		binary.Write(buf, binary.BigEndian, uint32(n.Expiration.Unix()))
+	}
+	binary.Write(buf, binary.BigEndian, uint8(5))
+	binary.Write(buf, binary.BigEndian, uint16(1))
+	binary.Write(buf, binary.BigEndian, uint8(n.Priority))
+
+	frame := &bytes.Buffer{}
+	binary.Write(frame, binary.BigEndian, uint8(2))
+	binary.Write(frame, binary.BigEndian, uint32(buf.Len()))
+	frame.Write(buf.Bytes())
+
+	return frame.Bytes()
+}
+
+var encodingPayload = payloadCase{
+	aps: func(p *apns.Payload) {
+		p.APS.Alert.Body = "I am a push notification!"
+		p.APS.Badge.Set(5)
+		p.APS.Sound = "turn_down_for_what.aiff"
+	},
+	custom: map[string]interface{}{
+		"link": "zombo://dot/com",
+		"game": map[string]int{"score": 234},
+	},
+}
+
+func encodingNotification() apns.Notification {
+	exp := time.Unix(1404102833, 0)
+
+	n := apns.NewNotification()
+	n.Payload = encodingPayload.payload()
+	n.DeviceToken = "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+	n.Identifier = 123123
+	n.Priority = apns.PriorityImmediate
+	n.Expiration = &exp
+
+	return n
+}
+
+var _ = Describe("Encoding", func() {
+	Describe("Notification", func() {
+		Describe("#AppendBinary", func() {
+			payloads := map[string]payloadCase{
+				"empty": {},
+				"simple alert": {
+					aps: func(p *apns.Payload) { p.APS.Alert.Body = "hello" },
+				},
+				"full alert": {
+					aps: func(p *apns.Payload) {
+						p.APS.Alert = apns.Alert{
+							Body:         "body",
+							Title:        "title",
+							Action:       "action",
+							LocKey:       "key",
+							LocArgs:      []string{"a", "b"},
+							ActionLocKey: "alk",
+							LaunchImage:  "img.png",
+						}
+					},
+				},
+				"every APS field": {
+					aps: func(p *apns.Payload) {
+						p.APS.Alert.Title = "title"
+						p.APS.Badge.Set(0)
+						p.APS.Sound = "default"
+						p.APS.ContentAvailable = 1
+						p.APS.URLArgs = []string{"x", "y"}
+						p.APS.Category = "NEWS"
+						p.APS.AccountId = "mail@example.com"
+					},
+				},
+				"escaped strings": {
+					aps: func(p *apns.Payload) {
+						p.APS.Alert.Body = "<b>\"Tom\" & \\Jerry\\</b>\n\t\b\f\r\x01\x1f \u2028 \u2029 é 😀 \xff\xfe"
+					},
+					custom: map[string]interface{}{"é<&>": "\x7f"},
+				},
+				"custom values around aps": {
+					aps: func(p *apns.Payload) { p.APS.Alert.Body = "hello" },
+					custom: map[string]interface{}{
+						"a": 1,
+						"b": []interface{}{"c", 2.5, nil, true},
+						"z": map[string]interface{}{"y": "x"},
+					},
+				},
+				"MDM": {
+					aps:    func(p *apns.Payload) { p.MDM = "00000000-1111-3333-4444-555555555555" },
+					custom: map[string]interface{}{"extra": "value"},
+				},
+			}
+
+			for name, c := range payloads {
+				name, c := name, c
+
+				It("should match the binary.Write encoding with a "+name+" payload", func() {
+					n := encodingNotification()
+					n.Payload = c.payload()
+
+					b, err := n.AppendBinary(nil)
+
+					Expect(err).To(BeNil())
+					Expect(b).To(Equal(legacyToBinary(n, referenceJSON(c))))
+				})
+			}
+
+			It("should match the binary.Write encoding with a nil payload", func() {
+				n := encodingNotification()
+				n.Payload = nil
+
+				b, err := n.AppendBinary(nil)
+
+				Expect(err).To(BeNil())
+				Expect(b).To(Equal(legacyToBinary(n, []byte("null"))))
+			})
+
+			It("should escape strings like encoding/json", func() {
+				ss := []string{
+					"<b>\"Tom\" & \\Jerry\\</b>", "\u2028\u2029", "é 😀", "\xff\xfe", "\xe2\x80", "\xed\xa0\x80",
+				}
+				for c := 0; c < 256; c++ {
+					ss = append(ss, string([]byte{byte(c)}), "a"+string([]byte{byte(c)})+"z")
+				}
+
+				// json.Marshal escapes HTML in MarshalJSON's output again, so
+				// this checks the frame
+				for _, s := range ss {
+					want, _ := json.Marshal(s)
+
+					n := encodingNotification()
+					n.Payload = apns.NewPayload()
+					n.Payload.APS.Sound = s
+
+					b, err := n.AppendBinary(nil)
+
+					Expect(err).To(BeNil())
+					Expect(b).To(Equal(legacyToBinary(n, []byte(`{"aps":{"sound":`+string(want)+`}}`))), "%q", s)
+				}
+			})
+
+			It("should append to dst", func() {
+				n := encodingNotification()
+
+				b, err := n.AppendBinary([]byte("prefix"))
+
+				Expect(err).To(BeNil())
+				Expect(b[:6]).To(Equal([]byte("prefix")))
+				Expect(b[6:]).To(Equal(legacyToBinary(n, referenceJSON(encodingPayload))))
+			})
+
+			It("should leave dst unchanged on error", func() {
+				n := encodingNotification()
+				n.DeviceToken = "totally not a valid token"
+
+				b, err := n.AppendBinary([]byte("prefix"))
+
+				Expect(err.Error()).To(ContainSubstring("convert token to hex error"))
+				Expect(b).To(Equal([]byte("prefix")))
+			})
+
+			It("should reject tokens of the wrong length", func() {
+				n := encodingNotification()
+				n.DeviceToken = "00a18269"
+
+				_, err := n.AppendBinary(nil)
+
+				Expect(err).To(Equal(apns.ErrBadDeviceToken))
+			})
+
+			It("should return errors marshalling custom values", func() {
+				n := encodingNotification()
+				n.Payload.SetCustomValue("bad", make(chan int))
+
+				_, err := n.AppendBinary(nil)
+
+				Expect(err).NotTo(BeNil())
+			})
+		})
+	})
+})
+
+func BenchmarkToBinaryLegacy(b *testing.B) {
+	n := encodingNotification()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		legacyToBinary(n, referenceJSON(encodingPayload))
+	}
+}
+
+func BenchmarkToBinary(b *testing.B) {
+	n := encodingNotification()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		n.ToBinary()
+	}
+}
+
+func BenchmarkAppendBinary(b *testing.B) {
+	n := encodingNotification()
+	b.ReportAllocs()
+
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf, _ = n.AppendBinary(buf[:0])
+	}
+}
+
+func BenchmarkAppendBinaryAPSOnly(b *testing.B) {
+	n := encodingNotification()
+	n.Payload = apns.NewPayload()
+	n.Payload.APS.Alert.Body = "I am a push notification!"
+	n.Payload.APS.Badge.Set(5)
+	b.ReportAllocs()
+
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf, _ = n.AppendBinary(buf[:0])
+	}
+}
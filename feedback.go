@@ -1,15 +1,28 @@
 package apns
 
 import (
-	"bytes"
 	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
+	"io"
+	"log"
+	"net"
 	"time"
 )
 
+// DefaultFeedbackReadTimeout is how long Feedback waits for data before
+// deciding the feedback service has nothing more to send
+const DefaultFeedbackReadTimeout = 100 * time.Millisecond
+
 type Feedback struct {
 	Conn *Conn
+
+	// ReadTimeout overrides DefaultFeedbackReadTimeout, e.g. for slow links
+	ReadTimeout time.Duration
+
+	// TokenStore is optional. When set, every token received is invalidated
+	// as of its feedback timestamp.
+	TokenStore TokenStore
 }
 
 type FeedbackTuple struct {
@@ -18,23 +31,68 @@ type FeedbackTuple struct {
 	DeviceToken string
 }
 
-func feedbackTupleFromBytes(b []byte) FeedbackTuple {
-	r := bytes.NewReader(b)
+// FeedbackDecodeError is returned when the feedback stream ends or times out
+// in the middle of a tuple
+type FeedbackDecodeError struct {
+	Err error
+}
 
-	var ts uint32
-	binary.Read(r, binary.BigEndian, &ts)
+func (e *FeedbackDecodeError) Error() string {
+	return "feedback tuple truncated: " + e.Err.Error()
+}
+
+// FeedbackDecoder reads feedback tuples from a stream
+type FeedbackDecoder struct {
+	r io.Reader
+}
+
+func NewFeedbackDecoder(r io.Reader) *FeedbackDecoder {
+	return &FeedbackDecoder{r: r}
+}
+
+// Decode reads the next tuple. Errors reading the first byte of a tuple are
+// returned as is, e.g. io.EOF at the end of the stream. Errors after that are
+// returned as a *FeedbackDecodeError.
+func (d *FeedbackDecoder) Decode() (FeedbackTuple, error) {
+	// Timestamp and token length
+	header := make([]byte, 4+2)
+
+	n, err := io.ReadFull(d.r, header)
+	if err != nil {
+		if n == 0 {
+			return FeedbackTuple{}, err
+		}
+		return FeedbackTuple{}, &FeedbackDecodeError{Err: err}
+	}
 
-	var tokLen uint16
-	binary.Read(r, binary.BigEndian, &tokLen)
+	ts := binary.BigEndian.Uint32(header[0:4])
+	tokLen := binary.BigEndian.Uint16(header[4:6])
 
 	tok := make([]byte, tokLen)
-	binary.Read(r, binary.BigEndian, &tok)
+	if _, err := io.ReadFull(d.r, tok); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return FeedbackTuple{}, &FeedbackDecodeError{Err: err}
+	}
 
 	return FeedbackTuple{
 		Timestamp:   time.Unix(int64(ts), 0),
 		TokenLength: tokLen,
 		DeviceToken: hex.EncodeToString(tok),
-	}
+	}, nil
+}
+
+// deadlineReader pushes the read deadline back before every read, so a slow
+// but steady stream doesn't time out
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(p)
 }
 
 func NewFeedbackWithCert(gw string, cert tls.Certificate) Feedback {
@@ -61,33 +119,85 @@ func NewFeedbackWithFiles(gw string, certFile string, keyFile string) (Feedback,
 	return Feedback{Conn: &conn}, nil
 }
 
+// NewFeedbackWithP12 creates a new Feedback from the PKCS#12 (.p12) bundle in
+// the specified file
+func NewFeedbackWithP12(gw string, p12File string, password string) (Feedback, error) {
+	conn, err := NewConnWithP12File(gw, p12File, password)
+	if err != nil {
+		return Feedback{}, err
+	}
+
+	return Feedback{Conn: &conn}, nil
+}
+
+// NewFeedbackWithP12Bytes creates a new Feedback from a PKCS#12 (.p12) bundle
+func NewFeedbackWithP12Bytes(gw string, p12 []byte, password string) (Feedback, error) {
+	conn, err := NewConnWithP12(gw, p12, password)
+	if err != nil {
+		return Feedback{}, err
+	}
+
+	return Feedback{Conn: &conn}, nil
+}
+
 // Receive returns a read only channel for APNs feedback. The returned channel
 // will close when there is no more data to be read.
 func (f Feedback) Receive() <-chan FeedbackTuple {
-	fc := make(chan FeedbackTuple)
-	go f.receive(fc)
+	fc, _ := f.ReceiveWithErrors()
 	return fc
 }
 
-func (f Feedback) receive(fc chan FeedbackTuple) {
+// ReceiveWithErrors is like Receive, but also returns a channel for the error
+// that ended the session early, such as a failure to connect or a
+// *FeedbackDecodeError. Nothing is sent on it when the feedback service simply
+// has no more data. Both channels are closed at the end of the session.
+func (f Feedback) ReceiveWithErrors() (<-chan FeedbackTuple, <-chan error) {
+	fc := make(chan FeedbackTuple)
+	errs := make(chan error, 1)
+
+	go func() {
+		if err := f.receive(fc); err != nil {
+			errs <- err
+		}
+		close(fc)
+		close(errs)
+	}()
+
+	return fc, errs
+}
+
+func (f Feedback) receive(fc chan<- FeedbackTuple) error {
 	err := f.Conn.Connect()
 	if err != nil {
-		close(fc)
-		return
+		return err
 	}
 	defer f.Conn.Close()
 
-	for {
-		b := make([]byte, 38)
+	timeout := f.ReadTimeout
+	if timeout == 0 {
+		timeout = DefaultFeedbackReadTimeout
+	}
+
+	d := NewFeedbackDecoder(deadlineReader{conn: f.Conn.NetConn, timeout: timeout})
 
-		f.Conn.NetConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		ft, err := d.Decode()
+		if _, ok := err.(*FeedbackDecodeError); ok {
+			return err
+		}
 
-		_, err := f.Conn.Read(b)
+		// Apple closes the connection, or goes quiet, when there's no more
+		// feedback
 		if err != nil {
-			close(fc)
-			return
+			return nil
+		}
+
+		if f.TokenStore != nil {
+			if err := f.TokenStore.InvalidateToken(ft.DeviceToken, ft.Timestamp); err != nil {
+				log.Println("err invalidating apns token", err.Error())
+			}
 		}
 
-		fc <- feedbackTupleFromBytes(b)
+		fc <- ft
 	}
 }
@@ -0,0 +1,214 @@
+package apns
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Apple recommends checking the feedback service at least once a day
+	DefaultFeedbackInterval   = 1 * time.Hour
+	DefaultFeedbackMaxBackoff = 10 * time.Minute
+
+	minFeedbackBackoff = 1 * time.Second
+)
+
+// TokenInvalidator is told about device tokens the feedback service reports
+// as no longer valid
+type TokenInvalidator interface {
+	// InvalidateToken is called with the time APNs determined the app no
+	// longer exists on the device. A token registered again after that time
+	// is still valid and should be kept.
+	InvalidateToken(token string, t time.Time) error
+}
+
+// FeedbackCheckpoint persists the timestamp of the newest feedback that was
+// processed, so it isn't processed again
+type FeedbackCheckpoint interface {
+	Load() (time.Time, error)
+	Save(t time.Time) error
+}
+
+// FileCheckpoint is a FeedbackCheckpoint stored in a file
+type FileCheckpoint struct {
+	Path string
+}
+
+// Load returns the saved timestamp, or the zero time if nothing was saved yet
+func (fc FileCheckpoint) Load() (time.Time, error) {
+	b, err := ioutil.ReadFile(fc.Path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	ts, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(ts, 0), nil
+}
+
+// Save atomically replaces the saved timestamp
+func (fc FileCheckpoint) Save(t time.Time) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fc.Path), filepath.Base(fc.Path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(strconv.FormatInt(t.Unix(), 10) + "\n")
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fc.Path)
+}
+
+// FeedbackPoller checks the feedback service on a schedule and passes every
+// tuple to a TokenInvalidator
+type FeedbackPoller struct {
+	Feedback    Feedback
+	Invalidator TokenInvalidator
+
+	// Checkpoint is optional. Without it, every tuple is processed.
+	Checkpoint FeedbackCheckpoint
+
+	// Interval between successful polls. Failed polls are retried with
+	// an exponential backoff capped at MaxBackoff. DefaultFeedbackInterval
+	// and DefaultFeedbackMaxBackoff are used when they're 0.
+	Interval   time.Duration
+	MaxBackoff time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewFeedbackPoller(f Feedback, inv TokenInvalidator) *FeedbackPoller {
+	return &FeedbackPoller{
+		Feedback:    f,
+		Invalidator: inv,
+		Interval:    DefaultFeedbackInterval,
+		MaxBackoff:  DefaultFeedbackMaxBackoff,
+	}
+}
+
+// Poll connects to the feedback service once and processes everything it
+// returns
+func (p *FeedbackPoller) Poll() error {
+	var since time.Time
+	if p.Checkpoint != nil {
+		var err error
+		if since, err = p.Checkpoint.Load(); err != nil {
+			return err
+		}
+	}
+
+	fc, errs := p.Feedback.ReceiveWithErrors()
+
+	newest := since
+	var invErr error
+
+	for ft := range fc {
+		// Timestamps are in whole seconds, so tuples from the checkpoint's
+		// second may not have been processed yet. Invalidating a token
+		// twice is harmless.
+		if ft.Timestamp.Before(since) {
+			continue
+		}
+
+		if err := p.Invalidator.InvalidateToken(ft.DeviceToken, ft.Timestamp); err != nil {
+			if invErr == nil {
+				invErr = err
+			}
+			continue
+		}
+
+		if ft.Timestamp.After(newest) {
+			newest = ft.Timestamp
+		}
+	}
+
+	err := <-errs
+	if err == nil {
+		err = invErr
+	}
+
+	// Don't move the checkpoint past tuples that couldn't be processed
+	if invErr == nil && p.Checkpoint != nil && newest.After(since) {
+		if serr := p.Checkpoint.Save(newest); err == nil {
+			err = serr
+		}
+	}
+
+	return err
+}
+
+// Start polls in the background until Stop is called
+func (p *FeedbackPoller) Start() {
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+
+	go p.run()
+}
+
+// Stop waits for the current poll to finish and stops polling
+func (p *FeedbackPoller) Stop() {
+	if p.stop == nil {
+		return
+	}
+
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+}
+
+func (p *FeedbackPoller) run() {
+	defer close(p.done)
+
+	interval := p.Interval
+	if interval <= 0 {
+		interval = DefaultFeedbackInterval
+	}
+
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultFeedbackMaxBackoff
+	}
+
+	backoff := minFeedbackBackoff
+
+	for {
+		wait := interval
+
+		if err := p.Poll(); err != nil {
+			log.Println("err polling apns feedback", err.Error())
+
+			if wait = backoff; wait > maxBackoff {
+				wait = maxBackoff
+			}
+			backoff = wait * 2
+		} else {
+			backoff = minFeedbackBackoff
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-p.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
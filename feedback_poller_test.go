@@ -0,0 +1,277 @@
+package apns_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+func feedbackBytes(ts uint32, tok string) []byte {
+	bt, _ := hex.DecodeString(tok)
+
+	b := bytes.NewBuffer([]byte{})
+	binary.Write(b, binary.BigEndian, ts)
+	binary.Write(b, binary.BigEndian, uint16(len(bt)))
+	binary.Write(b, binary.BigEndian, bt)
+
+	return b.Bytes()
+}
+
+type invalidation struct {
+	token string
+	ts    time.Time
+}
+
+type mockInvalidator struct {
+	sync.Mutex
+	invalidated []invalidation
+	err         error
+}
+
+func (m *mockInvalidator) InvalidateToken(token string, t time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	m.invalidated = append(m.invalidated, invalidation{token, t})
+	return nil
+}
+
+var _ = Describe("FeedbackPoller", func() {
+	t1 := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+	t2 := "00a1a4b7294fcfbc5293f63d4298fcecd9c20a893befd45adceead5fc92d3319"
+
+	var dir string
+
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "feedback")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("FileCheckpoint", func() {
+		It("should load the zero time before anything is saved", func() {
+			cp := apns.FileCheckpoint{Path: filepath.Join(dir, "checkpoint")}
+
+			t, err := cp.Load()
+			Expect(err).To(BeNil())
+			Expect(t.IsZero()).To(BeTrue())
+		})
+
+		It("should load what was saved", func() {
+			cp := apns.FileCheckpoint{Path: filepath.Join(dir, "checkpoint")}
+
+			Expect(cp.Save(time.Unix(1404358249, 0))).To(BeNil())
+
+			t, err := cp.Load()
+			Expect(err).To(BeNil())
+			Expect(t).To(Equal(time.Unix(1404358249, 0)))
+		})
+	})
+
+	Describe("#Poll", func() {
+		Context("could not connect", func() {
+			It("should return an error", func() {
+				s := &mockTLSServer{}
+
+				f, _ := apns.NewFeedback(s.Address(), DummyCert, DummyKey)
+				f.Conn.Conf.InsecureSkipVerify = true
+
+				p := apns.NewFeedbackPoller(f, &mockInvalidator{})
+				Expect(p.Poll()).NotTo(BeNil())
+			})
+		})
+
+		Context("with feedback", func() {
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: writeAction, data: feedbackBytes(1404358249, t1)},
+					serverAction{action: writeAction, data: feedbackBytes(1404352249, t2)},
+				},
+				[]serverAction{
+					serverAction{action: writeAction, data: feedbackBytes(1404358249, t1)},
+					serverAction{action: writeAction, data: feedbackBytes(1404358250, t2)},
+				},
+			}
+
+			It("should invalidate tokens once", func(d Done) {
+				withMockServer(as, func(s *mockTLSServer) {
+					f, _ := apns.NewFeedback(s.Address(), DummyCert, DummyKey)
+					f.Conn.Conf.InsecureSkipVerify = true
+
+					inv := &mockInvalidator{}
+					p := apns.NewFeedbackPoller(f, inv)
+					p.Checkpoint = apns.FileCheckpoint{Path: filepath.Join(dir, "checkpoint")}
+
+					Expect(p.Poll()).To(BeNil())
+					Expect(inv.invalidated).To(Equal([]invalidation{
+						{t1, time.Unix(1404358249, 0)},
+						{t2, time.Unix(1404352249, 0)},
+					}))
+
+					// The first tuple is from the checkpoint's second, so it's
+					// processed again in case it wasn't before
+					Expect(p.Poll()).To(BeNil())
+					Expect(inv.invalidated).To(HaveLen(4))
+					Expect(inv.invalidated[2]).To(Equal(invalidation{t1, time.Unix(1404358249, 0)}))
+					Expect(inv.invalidated[3]).To(Equal(invalidation{t2, time.Unix(1404358250, 0)}))
+
+					close(d)
+				})
+			}, 5)
+		})
+
+		Context("another token from the checkpoint's second", func() {
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: writeAction, data: feedbackBytes(1404358249, t1)},
+				},
+				[]serverAction{
+					serverAction{action: writeAction, data: feedbackBytes(1404358248, t1)},
+					serverAction{action: writeAction, data: feedbackBytes(1404358249, t2)},
+				},
+			}
+
+			It("should be invalidated", func(d Done) {
+				withMockServer(as, func(s *mockTLSServer) {
+					f, _ := apns.NewFeedback(s.Address(), DummyCert, DummyKey)
+					f.Conn.Conf.InsecureSkipVerify = true
+
+					inv := &mockInvalidator{}
+					p := apns.NewFeedbackPoller(f, inv)
+					p.Checkpoint = apns.FileCheckpoint{Path: filepath.Join(dir, "checkpoint")}
+
+					Expect(p.Poll()).To(BeNil())
+					Expect(p.Poll()).To(BeNil())
+					Expect(inv.invalidated).To(Equal([]invalidation{
+						{t1, time.Unix(1404358249, 0)},
+						{t2, time.Unix(1404358249, 0)},
+					}))
+
+					close(d)
+				})
+			}, 5)
+		})
+
+		Context("invalidator fails", func() {
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: writeAction, data: feedbackBytes(1404358249, t1)},
+				},
+			}
+
+			It("should not move the checkpoint", func(d Done) {
+				withMockServer(as, func(s *mockTLSServer) {
+					f, _ := apns.NewFeedback(s.Address(), DummyCert, DummyKey)
+					f.Conn.Conf.InsecureSkipVerify = true
+
+					cp := apns.FileCheckpoint{Path: filepath.Join(dir, "checkpoint")}
+					p := apns.NewFeedbackPoller(f, &mockInvalidator{err: errors.New("db down")})
+					p.Checkpoint = cp
+
+					Expect(p.Poll()).NotTo(BeNil())
+
+					t, _ := cp.Load()
+					Expect(t.IsZero()).To(BeTrue())
+
+					close(d)
+				})
+			}, 5)
+		})
+	})
+
+	Describe("#Start", func() {
+		Context("without Interval and MaxBackoff", func() {
+			It("should not poll in a loop after an error", func() {
+				var mu sync.Mutex
+				dials := 0
+
+				f, _ := apns.NewFeedback(apns.SandboxFeedbackGateway, DummyCert, DummyKey)
+				f.Conn.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+					mu.Lock()
+					defer mu.Unlock()
+
+					dials++
+					return nil, errors.New("unreachable")
+				}
+
+				p := &apns.FeedbackPoller{Feedback: f, Invalidator: &mockInvalidator{}}
+				p.Start()
+				time.Sleep(200 * time.Millisecond)
+				p.Stop()
+
+				mu.Lock()
+				defer mu.Unlock()
+				Expect(dials).To(Equal(1))
+			})
+
+			It("should not poll in a loop after a success", func(d Done) {
+				as := [][]serverAction{
+					[]serverAction{
+						serverAction{action: writeAction, data: feedbackBytes(1404358249, t1)},
+					},
+				}
+
+				withMockServer(as, func(s *mockTLSServer) {
+					f, _ := apns.NewFeedback(s.Address(), DummyCert, DummyKey)
+					f.Conn.Conf.InsecureSkipVerify = true
+
+					inv := &mockInvalidator{}
+					p := &apns.FeedbackPoller{Feedback: f, Invalidator: inv}
+					p.Start()
+					time.Sleep(500 * time.Millisecond)
+					p.Stop()
+
+					inv.Lock()
+					defer inv.Unlock()
+					Expect(inv.invalidated).To(HaveLen(1))
+
+					close(d)
+				})
+			}, 5)
+		})
+
+		as := [][]serverAction{
+			[]serverAction{
+				serverAction{action: writeAction, data: feedbackBytes(1404358249, t1)},
+			},
+		}
+
+		It("should poll until stopped", func(d Done) {
+			withMockServer(as, func(s *mockTLSServer) {
+				f, _ := apns.NewFeedback(s.Address(), DummyCert, DummyKey)
+				f.Conn.Conf.InsecureSkipVerify = true
+
+				inv := &mockInvalidator{}
+				p := apns.NewFeedbackPoller(f, inv)
+				p.Start()
+
+				Eventually(func() int {
+					inv.Lock()
+					defer inv.Unlock()
+					return len(inv.invalidated)
+				}).Should(Equal(1))
+
+				p.Stop()
+				close(d)
+			})
+		}, 5)
+	})
+})
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"os"
+	"testing/iotest"
 	"time"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -67,6 +69,77 @@ var _ = Describe("Feedback", func() {
 		})
 	})
 
+	Describe(".NewFeedbackWithP12", func() {
+		Context("missing file", func() {
+			It("should error out", func() {
+				_, err := apns.NewFeedbackWithP12(apns.ProductionGateway, "missing.p12", DummyP12Password)
+				Expect(err).NotTo(BeNil())
+			})
+		})
+	})
+
+	Describe(".NewFeedbackWithP12Bytes", func() {
+		Context("bad password", func() {
+			It("should error out", func() {
+				_, err := apns.NewFeedbackWithP12Bytes(apns.ProductionGateway, DummyP12, "wrong")
+				Expect(err).NotTo(BeNil())
+			})
+		})
+
+		Context("valid bundle", func() {
+			It("should create a valid feedback", func() {
+				f, err := apns.NewFeedbackWithP12Bytes(apns.ProductionGateway, DummyP12, DummyP12Password)
+				Expect(err).To(BeNil())
+				Expect(f.Conn).NotTo(BeNil())
+			})
+		})
+	})
+
+	Describe("FeedbackDecoder", func() {
+		t1 := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+		t2 := "00a1a4b7294fcfbc5293f63d4298fcec"
+
+		Context("short reads", func() {
+			It("should decode whole tuples", func() {
+				b := append(feedbackBytes(1404358249, t1), feedbackBytes(1404352249, t2)...)
+				d := apns.NewFeedbackDecoder(iotest.OneByteReader(bytes.NewReader(b)))
+
+				ft, err := d.Decode()
+				Expect(err).To(BeNil())
+				Expect(ft.DeviceToken).To(Equal(t1))
+
+				ft, err = d.Decode()
+				Expect(err).To(BeNil())
+				Expect(ft.Timestamp).To(Equal(time.Unix(1404352249, 0)))
+				Expect(ft.TokenLength).To(Equal(uint16(16)))
+				Expect(ft.DeviceToken).To(Equal(t2))
+
+				_, err = d.Decode()
+				Expect(err).To(Equal(io.EOF))
+			})
+		})
+
+		Context("truncated header", func() {
+			It("should return a decode error", func() {
+				d := apns.NewFeedbackDecoder(bytes.NewReader(feedbackBytes(1404358249, t1)[:3]))
+
+				_, err := d.Decode()
+				Expect(err).To(BeAssignableToTypeOf(&apns.FeedbackDecodeError{}))
+			})
+		})
+
+		Context("truncated token", func() {
+			It("should return a decode error", func() {
+				b := feedbackBytes(1404358249, t1)
+				d := apns.NewFeedbackDecoder(bytes.NewReader(b[:len(b)-1]))
+
+				_, err := d.Decode()
+				Expect(err).To(BeAssignableToTypeOf(&apns.FeedbackDecodeError{}))
+				Expect(err.(*apns.FeedbackDecodeError).Err).To(Equal(io.ErrUnexpectedEOF))
+			})
+		})
+	})
+
 	Describe("#Receive", func() {
 		Context("could not connect", func() {
 			It("should not receive anything", func() {
@@ -171,5 +244,110 @@ var _ = Describe("Feedback", func() {
 				})
 			})
 		})
+
+		Context("with a token store", func() {
+			t1 := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: writeAction, data: feedbackBytes(1404358249, t1)},
+				},
+			}
+
+			It("should invalidate the tokens", func(d Done) {
+				withMockServer(as, func(s *mockTLSServer) {
+					f, _ := apns.NewFeedback(s.Address(), DummyCert, DummyKey)
+					f.Conn.Conf.InsecureSkipVerify = true
+
+					store := apns.NewMemoryTokenStore()
+					f.TokenStore = store
+
+					for _ = range f.Receive() {
+					}
+
+					valid, _ := store.TokenValid(t1)
+					Expect(valid).To(BeFalse())
+
+					close(d)
+				})
+			})
+		})
+
+		Context("tuple split across slow writes", func() {
+			t1 := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+			b := feedbackBytes(1404358249, t1)
+
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: writeAction, data: b[:10], cb: func(a serverAction) {
+						time.Sleep(60 * time.Millisecond)
+					}},
+					serverAction{action: writeAction, data: b[10:20], cb: func(a serverAction) {
+						time.Sleep(60 * time.Millisecond)
+					}},
+					serverAction{action: writeAction, data: b[20:]},
+				},
+			}
+
+			It("should receive the whole tuple", func(d Done) {
+				withMockServer(as, func(s *mockTLSServer) {
+					f, _ := apns.NewFeedback(s.Address(), DummyCert, DummyKey)
+					f.Conn.Conf.InsecureSkipVerify = true
+
+					c, errs := f.ReceiveWithErrors()
+
+					r := <-c
+					Expect(r.DeviceToken).To(Equal(t1))
+
+					_, ok := <-c
+					Expect(ok).To(BeFalse())
+					Expect(<-errs).To(BeNil())
+
+					close(d)
+				})
+			})
+		})
+	})
+
+	Describe("#ReceiveWithErrors", func() {
+		Context("could not connect", func() {
+			It("should return the error", func() {
+				s := &mockTLSServer{}
+
+				f, _ := apns.NewFeedback(s.Address(), DummyCert, DummyKey)
+				f.Conn.Conf.InsecureSkipVerify = true
+
+				c, errs := f.ReceiveWithErrors()
+				for _ = range c {
+				}
+
+				Expect(<-errs).NotTo(BeNil())
+			})
+		})
+
+		Context("times out mid tuple", func() {
+			t1 := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: writeAction, data: feedbackBytes(1404358249, t1)[:20]},
+				},
+			}
+
+			It("should return a decode error", func(d Done) {
+				withMockServer(as, func(s *mockTLSServer) {
+					f, _ := apns.NewFeedback(s.Address(), DummyCert, DummyKey)
+					f.Conn.Conf.InsecureSkipVerify = true
+
+					c, errs := f.ReceiveWithErrors()
+					for _ = range c {
+					}
+
+					Expect(<-errs).To(BeAssignableToTypeOf(&apns.FeedbackDecodeError{}))
+
+					close(d)
+				})
+			})
+		})
 	})
 })
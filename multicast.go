@@ -0,0 +1,81 @@
+package apns
+
+import "time"
+
+// MulticastOptions are the settings of every notification sent by
+// Client.Multicast
+type MulticastOptions struct {
+	// ID is given to every notification as ID:token, to tell them apart in
+	// FailedNotifs and ResultHandler calls. IDs are left empty when it is.
+	ID string
+
+	Priority   int
+	Expiration *time.Time
+
+	CollapseID string
+	PushType   PushType
+	Topic      string
+}
+
+// MulticastResult is what became of a Client.Multicast
+type MulticastResult struct {
+	// Queued is how many notifications were accepted for sending
+	Queued int
+
+	// Failed has the tokens Send rejected, with the reason. Notifications
+	// APNs rejects are reported like any other, through FailedNotifs and
+	// the ResultHandler.
+	Failed map[string]error
+}
+
+// Multicast sends p to every token in tokens. p is marshalled once and shared
+// by the notifications, so it mustn't be modified until they've been written.
+// An invalid payload or headers, or a push type the client doesn't send, are
+// returned as an error before anything is sent.
+func (c *Client) Multicast(p *Payload, tokens []string, opts MulticastOptions) (MulticastResult, error) {
+	j, err := p.appendJSON(nil)
+	if err != nil {
+		return MulticastResult{}, err
+	}
+
+	tmpl := Notification{
+		Expiration: opts.Expiration,
+		Priority:   opts.Priority,
+		Payload:    p,
+		CollapseID: opts.CollapseID,
+		PushType:   opts.PushType,
+		Topic:      opts.Topic,
+		shared:     &sharedPayload{p: p, json: j},
+	}
+
+	if len(j) > tmpl.maxPayloadSize() {
+		return MulticastResult{}, ErrPayloadTooLarge
+	}
+
+	if err := tmpl.ValidateHeaders(); err != nil {
+		return MulticastResult{}, err
+	}
+
+	if err := c.voipError(tmpl); err != nil {
+		return MulticastResult{}, err
+	}
+
+	res := MulticastResult{Failed: map[string]error{}}
+	for _, tok := range tokens {
+		n := tmpl
+		n.DeviceToken = tok
+
+		if opts.ID != "" {
+			n.ID = opts.ID + ":" + tok
+		}
+
+		if err := c.Send(n); err != nil {
+			res.Failed[tok] = err
+			continue
+		}
+
+		res.Queued++
+	}
+
+	return res, nil
+}
@@ -0,0 +1,192 @@
+package apns_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+// payloadFilter replaces the payload of every notification
+type payloadFilter struct {
+	p *apns.Payload
+}
+
+func (f payloadFilter) FilterSend(n *apns.Notification, now time.Time) (time.Time, error) {
+	n.Payload = f.p
+	return time.Time{}, nil
+}
+
+var _ = Describe("Multicast", func() {
+	tok1 := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+	tok2 := "9999999999999999999999999999999999999999999999999999999999999999"
+
+	p := apns.NewPayload()
+	p.APS.Alert.Body = "Everyone!"
+	p.SetCustomValue("link", "zombo://dot/com")
+
+	// The frames for tok1 and tok2, written with identifiers 1 and 2
+	frames := func(p *apns.Payload) ([]byte, []byte) {
+		n1 := apns.Notification{Identifier: 1, DeviceToken: tok1, Payload: p, Priority: apns.PriorityImmediate}
+		n2 := apns.Notification{Identifier: 2, DeviceToken: tok2, Payload: p, Priority: apns.PriorityImmediate}
+
+		b1, _ := n1.ToBinary()
+		b2, _ := n2.ToBinary()
+
+		return b1, b2
+	}
+
+	Context("valid tokens", func() {
+		It("should send the payload to each of them", func(d Done) {
+			mockDone := make(chan interface{})
+			want1, want2 := frames(p)
+
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}},
+					serverAction{action: readAction, data: make([]byte, len(want1)), cb: func(a serverAction) {
+						Expect(a.data).To(Equal(want1))
+					}},
+					serverAction{action: readAction, data: make([]byte, len(want2)), cb: func(a serverAction) {
+						Expect(a.data).To(Equal(want2))
+
+						close(mockDone)
+						close(d)
+					}},
+				},
+			}
+
+			withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+				c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+				c.Conn.Conf.InsecureSkipVerify = true
+
+				res, err := c.Multicast(p, []string{tok1, tok2}, apns.MulticastOptions{Priority: apns.PriorityImmediate})
+
+				Expect(err).To(BeNil())
+				Expect(res.Queued).To(Equal(2))
+				Expect(res.Failed).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("a filter replacing the payload", func() {
+		It("should send the new payload", func(d Done) {
+			mockDone := make(chan interface{})
+
+			other := apns.NewPayload()
+			other.APS.Alert.Body = "Someone else"
+			want1, want2 := frames(other)
+
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}},
+					serverAction{action: readAction, data: make([]byte, len(want1)), cb: func(a serverAction) {
+						Expect(a.data).To(Equal(want1))
+					}},
+					serverAction{action: readAction, data: make([]byte, len(want2)), cb: func(a serverAction) {
+						Expect(a.data).To(Equal(want2))
+
+						close(mockDone)
+						close(d)
+					}},
+				},
+			}
+
+			withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+				c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+				c.Conn.Conf.InsecureSkipVerify = true
+				c.Filters = []apns.SendFilter{payloadFilter{other}}
+
+				_, err := c.Multicast(p, []string{tok1, tok2}, apns.MulticastOptions{Priority: apns.PriorityImmediate})
+
+				Expect(err).To(BeNil())
+			})
+		})
+	})
+
+	Context("a token APNs rejects", func() {
+		It("should report it with its ID", func(d Done) {
+			mockDone := make(chan interface{})
+			want1, want2 := frames(p)
+
+			errPayload := bytes.NewBuffer([]byte{})
+			binary.Write(errPayload, binary.BigEndian, uint8(8))
+			binary.Write(errPayload, binary.BigEndian, uint8(8))
+			binary.Write(errPayload, binary.BigEndian, uint32(2))
+
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}},
+					serverAction{action: readAction, data: make([]byte, len(want1))},
+					serverAction{action: readAction, data: make([]byte, len(want2))},
+					serverAction{action: writeAction, data: errPayload.Bytes()},
+					serverAction{action: closeAction},
+				},
+			}
+
+			withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+				c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+				c.Conn.Conf.InsecureSkipVerify = true
+
+				go func() {
+					f := <-c.FailedNotifs
+					Expect(f.Notif.ID).To(Equal("launch:" + tok2))
+					Expect(f.Notif.DeviceToken).To(Equal(tok2))
+
+					close(mockDone)
+					close(d)
+				}()
+
+				_, err := c.Multicast(p, []string{tok1, tok2}, apns.MulticastOptions{ID: "launch", Priority: apns.PriorityImmediate})
+
+				Expect(err).To(BeNil())
+			})
+		})
+	})
+
+	Context("tokens Send rejects", func() {
+		It("should list them in Failed", func() {
+			c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+
+			store := apns.NewMemoryTokenStore()
+			store.InvalidateToken(tok1, time.Now())
+			c.TokenStore = store
+
+			res, err := c.Multicast(p, []string{tok1, "bad"}, apns.MulticastOptions{})
+
+			Expect(err).To(BeNil())
+			Expect(res.Queued).To(Equal(0))
+			Expect(res.Failed).To(HaveLen(2))
+			Expect(res.Failed[tok1]).To(Equal(apns.ErrTokenInvalidated))
+			Expect(res.Failed["bad"]).NotTo(BeNil())
+		})
+	})
+
+	Context("a payload that's too large", func() {
+		It("should return an error", func() {
+			c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+
+			big := apns.NewPayload()
+			big.APS.Alert.Body = strings.Repeat("x", apns.MaxPayloadSize)
+
+			res, err := c.Multicast(big, []string{tok1, tok2}, apns.MulticastOptions{})
+
+			Expect(err).To(Equal(apns.ErrPayloadTooLarge))
+			Expect(res.Queued).To(Equal(0))
+		})
+	})
+
+	Context("invalid headers", func() {
+		It("should return an error", func() {
+			c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+
+			_, err := c.Multicast(p, []string{tok1, tok2}, apns.MulticastOptions{PushType: "bogus"})
+
+			Expect(err).To(Equal(apns.ErrInvalidPushType))
+		})
+	})
+})
@@ -1,12 +1,13 @@
 package apns
 
 import (
-	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -15,6 +16,83 @@ const (
 	PriorityPowerConserve = 5
 )
 
+// PushType is the kind of notification, sent as the apns-push-type header
+type PushType string
+
+const (
+	PushTypeAlert        PushType = "alert"
+	PushTypeBackground   PushType = "background"
+	PushTypeVoIP         PushType = "voip"
+	PushTypeComplication PushType = "complication"
+	PushTypeFileProvider PushType = "fileprovider"
+	PushTypeMDM          PushType = "mdm"
+	PushTypeLocation     PushType = "location"
+	PushTypeLiveActivity PushType = "liveactivity"
+	PushTypePushToTalk   PushType = "pushtotalk"
+)
+
+// pushTypeTopicSuffixes are the suffixes apns-topic must have for push types
+// that aren't sent to the bundle ID itself
+var pushTypeTopicSuffixes = map[PushType]string{
+	PushTypeVoIP:         ".voip",
+	PushTypeComplication: ".complication",
+	PushTypeFileProvider: ".pushkit.fileprovider",
+	PushTypeLocation:     ".location-query",
+	PushTypeLiveActivity: ".push-type.liveactivity",
+	PushTypePushToTalk:   ".voip-ptt",
+}
+
+func (t PushType) valid() bool {
+	switch t {
+	case PushTypeAlert, PushTypeBackground, PushTypeMDM:
+		return true
+	}
+
+	_, ok := pushTypeTopicSuffixes[t]
+	return ok
+}
+
+const (
+	// MaxCollapseIDLength is the longest apns-collapse-id, in bytes
+	MaxCollapseIDLength = 64
+
+	// MaxPayloadSize is the largest JSON payload APNs accepts, in bytes,
+	// except for VoIP notifications
+	MaxPayloadSize = 2048
+)
+
+var (
+	ErrCollapseIDTooLong     = errors.New("collapse ID is longer than 64 bytes")
+	ErrInvalidPushType       = errors.New("unknown push type")
+	ErrBackgroundPriority    = errors.New("background notifications must have priority 5")
+	ErrTopicPushTypeMismatch = errors.New("topic doesn't match push type")
+	ErrInvalidAPNSID         = errors.New("APNs ID is not a UUID")
+
+	ErrBadDeviceToken  = errors.New("device token is not 32 bytes of hex")
+	ErrBadPriority     = errors.New("priority is neither 5 nor 10")
+	ErrExpired         = errors.New("notification has already expired")
+	ErrPayloadTooLarge = errors.New("payload is larger than APNs allows")
+)
+
+// ValidationError lists everything wrong with a notification. It matches each
+// of its errors with errors.Is.
+type ValidationError struct {
+	Errs []error
+}
+
+func (e *ValidationError) Error() string {
+	s := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		s[i] = err.Error()
+	}
+
+	return "invalid notification: " + strings.Join(s, "; ")
+}
+
+func (e *ValidationError) Unwrap() []error {
+	return e.Errs
+}
+
 const (
 	commandID = 2
 
@@ -32,6 +110,9 @@ const (
 	priorityItemLength               = 1
 )
 
+// NotificationResult is a notification APNs rejected. Notif has the
+// Identifier it was sent with, while Err has the one it was written with,
+// which differs when that was 0 or already in use.
 type NotificationResult struct {
 	Notif Notification
 	Err   Error
@@ -66,36 +147,43 @@ type APS struct {
 	AccountId        string // for email push notifications
 }
 
+// MarshalJSON writes the set fields sorted by key
 func (aps APS) MarshalJSON() ([]byte, error) {
-	data := make(map[string]interface{})
+	return aps.appendJSON(nil), nil
+}
 
-	if !aps.Alert.isZero() {
-		if aps.Alert.isSimple() {
-			data["alert"] = aps.Alert.Body
-		} else {
-			data["alert"] = aps.Alert
-		}
-	}
-	if aps.Badge.IsSet {
-		data["badge"] = aps.Badge
+func (aps *APS) UnmarshalJSON(b []byte) error {
+	var data struct {
+		Alert            json.RawMessage `json:"alert"`
+		Badge            BadgeNumber     `json:"badge"`
+		Sound            string          `json:"sound"`
+		ContentAvailable int             `json:"content-available"`
+		URLArgs          []string        `json:"url-args"`
+		Category         string          `json:"category"`
+		AccountId        string          `json:"account-id"`
 	}
-	if aps.Sound != "" {
-		data["sound"] = aps.Sound
-	}
-	if aps.ContentAvailable != 0 {
-		data["content-available"] = aps.ContentAvailable
-	}
-	if aps.Category != "" {
-		data["category"] = aps.Category
+
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
 	}
-	if aps.URLArgs != nil && len(aps.URLArgs) != 0 {
-		data["url-args"] = aps.URLArgs
+
+	*aps = APS{
+		Badge:            data.Badge,
+		Sound:            data.Sound,
+		ContentAvailable: data.ContentAvailable,
+		URLArgs:          data.URLArgs,
+		Category:         data.Category,
+		AccountId:        data.AccountId,
 	}
-	if aps.AccountId != "" {
-		data["account-id"] = aps.AccountId
+
+	// The alert is either just the body, or the whole Alert
+	if len(data.Alert) > 0 && data.Alert[0] == '"' {
+		return json.Unmarshal(data.Alert, &aps.Alert.Body)
+	} else if len(data.Alert) > 0 {
+		return json.Unmarshal(data.Alert, &aps.Alert)
 	}
 
-	return json.Marshal(data)
+	return nil
 }
 
 type Payload struct {
@@ -105,14 +193,41 @@ type Payload struct {
 	customValues map[string]interface{}
 }
 
+// MarshalJSON writes "aps", or "mdm" when MDM is set, followed by the custom
+// values sorted by key. The output only depends on the payload's contents,
+// and p isn't modified, so it can be marshalled from several goroutines.
 func (p *Payload) MarshalJSON() ([]byte, error) {
-	if len(p.MDM) != 0 {
-		p.customValues["mdm"] = p.MDM
-	} else {
-		p.customValues["aps"] = p.APS
+	return p.appendJSON(nil)
+}
+
+func (p *Payload) UnmarshalJSON(b []byte) error {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	*p = Payload{customValues: map[string]interface{}{}}
+
+	for k, v := range data {
+		var err error
+
+		switch k {
+		case "aps":
+			err = json.Unmarshal(v, &p.APS)
+		case "mdm":
+			err = json.Unmarshal(v, &p.MDM)
+		default:
+			var cv interface{}
+			err = json.Unmarshal(v, &cv)
+			p.customValues[k] = cv
+		}
+
+		if err != nil {
+			return err
+		}
 	}
 
-	return json.Marshal(p.customValues)
+	return nil
 }
 
 func (p *Payload) SetCustomValue(key string, value interface{}) error {
@@ -132,6 +247,33 @@ type Notification struct {
 	Expiration  *time.Time
 	Priority    int
 	Payload     *Payload
+
+	// HTTP/2 request headers. The binary protocol has no equivalent, so
+	// ToBinary ignores them.
+	CollapseID string
+	PushType   PushType
+	Topic      string
+	APNSID     string
+
+	// Set when the notification was added to the client's Outbox
+	outboxID uint64
+
+	// The identifier the client wrote the notification with, and when
+	wireID uint32
+	sentAt time.Time
+
+	// Set on the client's sentinel notifications
+	sentinel bool
+
+	// Set once the client confirmed the notification early, see SettleTime
+	settled bool
+
+	// Set once the client deferred the notification, after its
+	// Deduplicator saw it
+	deferred bool
+
+	// Set by Client.Multicast to the payload marshalled once
+	shared *sharedPayload
 }
 
 func NewNotification() Notification {
@@ -142,51 +284,162 @@ func NewPayload() *Payload {
 	return &Payload{customValues: map[string]interface{}{}}
 }
 
-func (n Notification) ToBinary() ([]byte, error) {
-	b := []byte{}
+// NewAPNSID returns a random (version 4) UUID to use as a Notification's
+// APNSID
+func NewAPNSID() string {
+	u := make([]byte, 16)
+	rand.Read(u)
 
-	binTok, err := hex.DecodeString(n.DeviceToken)
-	if err != nil {
-		return b, fmt.Errorf("convert token to hex error: %s", err)
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+func validUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if s[i] != '-' {
+				return false
+			}
+		case '0' <= s[i] && s[i] <= '9', 'a' <= s[i] && s[i] <= 'f', 'A' <= s[i] && s[i] <= 'F':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// headerErrors returns every problem with the HTTP/2 header fields
+func (n Notification) headerErrors() []error {
+	errs := []error{}
+
+	if len(n.CollapseID) > MaxCollapseIDLength {
+		errs = append(errs, ErrCollapseIDTooLong)
 	}
 
-	j, _ := json.Marshal(n.Payload)
+	if n.PushType != "" && !n.PushType.valid() {
+		errs = append(errs, ErrInvalidPushType)
+	}
 
-	buf := bytes.NewBuffer(b)
+	if n.PushType == PushTypeBackground && n.Priority != PriorityPowerConserve {
+		errs = append(errs, ErrBackgroundPriority)
+	}
+
+	if n.PushType == PushTypeVoIP && n.Priority == PriorityPowerConserve {
+		errs = append(errs, ErrVoIPPriority)
+	}
+
+	if suffix, ok := pushTypeTopicSuffixes[n.PushType]; ok && n.Topic != "" && !strings.HasSuffix(n.Topic, suffix) {
+		errs = append(errs, ErrTopicPushTypeMismatch)
+	}
+
+	if n.APNSID != "" && !validUUID(n.APNSID) {
+		errs = append(errs, ErrInvalidAPNSID)
+	}
+
+	return errs
+}
+
+// Validate checks n the way APNs would, and returns a *ValidationError with
+// every problem found. A zero Priority is left for APNs to default.
+func (n Notification) Validate() error {
+	errs := []error{}
+
+	if tok, err := hex.DecodeString(n.DeviceToken); err != nil || len(tok) != deviceTokenItemLength {
+		errs = append(errs, ErrBadDeviceToken)
+	}
+
+	if n.Priority != 0 && n.Priority != PriorityImmediate && n.Priority != PriorityPowerConserve {
+		errs = append(errs, ErrBadPriority)
+	}
+
+	if n.Expiration != nil && !n.Expiration.After(time.Now()) {
+		errs = append(errs, ErrExpired)
+	}
+
+	if j, err := n.payloadJSON(); err != nil {
+		errs = append(errs, err)
+	} else if len(j) > n.maxPayloadSize() {
+		errs = append(errs, ErrPayloadTooLarge)
+	}
+
+	errs = append(errs, n.headerErrors()...)
+
+	if len(errs) > 0 {
+		return &ValidationError{Errs: errs}
+	}
+
+	return nil
+}
+
+// ValidateHeaders checks CollapseID, PushType, Topic and APNSID, and returns
+// the first problem found
+func (n Notification) ValidateHeaders() error {
+	if errs := n.headerErrors(); len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+// ToBinary encodes n for the binary protocol. CollapseID, PushType, Topic and
+// APNSID aren't part of it and are left out.
+func (n Notification) ToBinary() ([]byte, error) {
+	return n.AppendBinary(nil)
+}
+
+// AppendBinary appends n encoded like ToBinary to dst, and returns the
+// extended buffer. Reusing dst avoids allocating a frame per notification. On
+// error dst is returned unchanged.
+func (n Notification) AppendBinary(dst []byte) ([]byte, error) {
+	start := len(dst)
+
+	// Command and frame length, set once the items are written
+	dst = append(dst, commandID, 0, 0, 0, 0)
 
 	// Token
-	binary.Write(buf, binary.BigEndian, uint8(deviceTokenItemID))
-	binary.Write(buf, binary.BigEndian, uint16(deviceTokenItemLength))
-	binary.Write(buf, binary.BigEndian, binTok)
+	dst = append(dst, deviceTokenItemID, 0, deviceTokenItemLength)
+	dst, err := appendToken(dst, n.DeviceToken)
+	if err != nil {
+		return dst[:start], err
+	}
 
 	// Payload
-	binary.Write(buf, binary.BigEndian, uint8(payloadItemID))
-	binary.Write(buf, binary.BigEndian, uint16(len(j)))
-	binary.Write(buf, binary.BigEndian, j)
+	dst = append(dst, payloadItemID, 0, 0)
+	p := len(dst)
+	if j := n.sharedJSON(); j != nil {
+		dst = append(dst, j...)
+	} else {
+		dst, err = n.Payload.appendJSON(dst)
+	}
+	if err != nil {
+		return dst[:start], err
+	}
+	binary.BigEndian.PutUint16(dst[p-2:], uint16(len(dst)-p))
 
 	// Identifier
-	binary.Write(buf, binary.BigEndian, uint8(notificationIdentifierItemID))
-	binary.Write(buf, binary.BigEndian, uint16(notificationIdentifierItemLength))
-	binary.Write(buf, binary.BigEndian, uint32(n.Identifier))
+	dst = append(dst, notificationIdentifierItemID, 0, notificationIdentifierItemLength)
+	dst = binary.BigEndian.AppendUint32(dst, n.Identifier)
 
 	// Expiry
-	binary.Write(buf, binary.BigEndian, uint8(expirationDateItemID))
-	binary.Write(buf, binary.BigEndian, uint16(expirationDateItemLength))
-	if n.Expiration == nil {
-		binary.Write(buf, binary.BigEndian, uint32(0))
-	} else {
-		binary.Write(buf, binary.BigEndian, uint32(n.Expiration.Unix()))
+	var exp uint32
+	if n.Expiration != nil {
+		exp = uint32(n.Expiration.Unix())
 	}
+	dst = append(dst, expirationDateItemID, 0, expirationDateItemLength)
+	dst = binary.BigEndian.AppendUint32(dst, exp)
 
 	// Priority
-	binary.Write(buf, binary.BigEndian, uint8(priorityItemID))
-	binary.Write(buf, binary.BigEndian, uint16(priorityItemLength))
-	binary.Write(buf, binary.BigEndian, uint8(n.Priority))
+	dst = append(dst, priorityItemID, 0, priorityItemLength, uint8(n.Priority))
 
-	framebuf := bytes.NewBuffer([]byte{})
-	binary.Write(framebuf, binary.BigEndian, uint8(commandID))
-	binary.Write(framebuf, binary.BigEndian, uint32(buf.Len()))
-	binary.Write(framebuf, binary.BigEndian, buf.Bytes())
+	binary.BigEndian.PutUint32(dst[start+1:], uint32(len(dst)-start-5))
 
-	return framebuf.Bytes(), nil
+	return dst, nil
 }
@@ -4,6 +4,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -11,6 +16,63 @@ import (
 	"github.com/timehop/apns"
 )
 
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenPayloads are marshalled and compared to testdata/payloads/<name>.json,
+// which must also match referenceJSON
+var goldenPayloads = map[string]payloadCase{
+	"simple": {
+		aps: func(p *apns.Payload) {
+			p.APS.Alert.Body = "I am a push notification!"
+			p.APS.Badge.Set(5)
+			p.APS.Sound = "turn_down_for_what.aiff"
+		},
+	},
+	"alert_dictionary": {
+		aps: func(p *apns.Payload) {
+			p.APS.Alert = apns.Alert{
+				Body:         "Bob wants to play poker",
+				Title:        "Game Request",
+				Action:       "PLAY",
+				LocKey:       "GAME_PLAY_REQUEST_FORMAT",
+				LocArgs:      []string{"Jenna", "Frank"},
+				ActionLocKey: "PLAY",
+				LaunchImage:  "Default.png",
+			}
+		},
+	},
+	"all_aps_fields": {
+		aps: func(p *apns.Payload) {
+			p.APS.Alert.Body = "New mail"
+			p.APS.Badge.Set(0)
+			p.APS.Sound = "default"
+			p.APS.ContentAvailable = 1
+			p.APS.URLArgs = []string{"boarding", "A998"}
+			p.APS.Category = "MAIL"
+			p.APS.AccountId = "mail@example.com"
+		},
+	},
+	"custom_values": {
+		aps: func(p *apns.Payload) { p.APS.Alert.Body = "Score!" },
+		custom: map[string]interface{}{
+			"link": "zombo://dot/com",
+			"game": map[string]int{"score": 234, "level": 3},
+			"Acme": []interface{}{"a", 1.5, true, nil},
+			"zz": struct {
+				Name string `json:"name"`
+			}{"last"},
+		},
+	},
+	"escaping": {
+		aps:    func(p *apns.Payload) { p.APS.Alert.Body = "<b>\"Tom\" & Jerry</b>\n\u2028é 😀" },
+		custom: map[string]interface{}{"url": "https://example.com/?a=1&b=2"},
+	},
+	"mdm": {
+		aps:    func(p *apns.Payload) { p.MDM = "00000000-1111-3333-4444-555555555555" },
+		custom: map[string]interface{}{"extra": "value"},
+	},
+}
+
 var _ = Describe("Notifications", func() {
 	Describe("Alert", func() {
 		Describe("JSON marshalling", func() {
@@ -162,6 +224,138 @@ var _ = Describe("Notifications", func() {
 					Expect(b).To(Equal([]byte(`{"mdm":"00000000-1111-3333-4444-555555555555"}`)))
 				})
 			})
+
+			Context("with custom values before and after aps", func() {
+				It("should put aps first and sort the rest", func() {
+					p := apns.NewPayload()
+
+					p.APS.Alert.Body = "testing"
+					p.SetCustomValue("zebra", 1)
+					p.SetCustomValue("apple", 2)
+					p.SetCustomValue("Banana", 3)
+
+					b, err := json.Marshal(p)
+
+					Expect(err).To(BeNil())
+					Expect(b).To(Equal([]byte(`{"aps":{"alert":"testing"},"Banana":3,"apple":2,"zebra":1}`)))
+				})
+			})
+
+			Context("after MDM is cleared", func() {
+				It("should not keep it", func() {
+					p := apns.NewPayload()
+
+					p.MDM = "00000000-1111-3333-4444-555555555555"
+					json.Marshal(p)
+					p.MDM = ""
+
+					b, err := json.Marshal(p)
+
+					Expect(err).To(BeNil())
+					Expect(b).To(Equal([]byte(`{"aps":{}}`)))
+				})
+			})
+
+			Context("from several goroutines", func() {
+				It("should give the same output", func() {
+					p := apns.NewPayload()
+
+					p.APS.Alert.Body = "testing"
+					p.SetCustomValue("email", "come@me.bro")
+					p.SetCustomValue("game", map[string]int{"score": 234})
+
+					want, _ := json.Marshal(p)
+
+					var wg sync.WaitGroup
+					out := make(chan []byte, 20)
+					for i := 0; i < 20; i++ {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							b, _ := json.Marshal(p)
+							out <- b
+						}()
+					}
+					wg.Wait()
+					close(out)
+
+					for b := range out {
+						Expect(b).To(Equal(want))
+					}
+				})
+			})
+
+			Context("golden files", func() {
+				for name, c := range goldenPayloads {
+					name, c := name, c
+
+					It("should match testdata/payloads/"+name+".json", func() {
+						b, err := json.Marshal(c.payload())
+						Expect(err).To(BeNil())
+						Expect(string(b)).To(Equal(string(referenceJSON(c))))
+
+						path := filepath.Join("testdata", "payloads", name+".json")
+						if *updateGolden {
+							Expect(ioutil.WriteFile(path, append(b, '\n'), 0644)).To(Succeed())
+						}
+
+						golden, err := ioutil.ReadFile(path)
+						Expect(err).To(BeNil())
+						Expect(string(b)).To(Equal(strings.TrimSuffix(string(golden), "\n")))
+					})
+				}
+			})
+		})
+	})
+
+	Describe("Payload", func() {
+		Describe("#UnmarshalJSON", func() {
+			Context("simple alert with custom values", func() {
+				It("should round trip", func() {
+					p := apns.NewPayload()
+					p.APS.Alert.Body = "testing"
+					p.APS.Badge.Set(0)
+					p.APS.Sound = "default"
+					p.SetCustomValue("email", "come@me.bro")
+
+					b, _ := json.Marshal(p)
+
+					up := apns.NewPayload()
+					Expect(json.Unmarshal(b, up)).To(BeNil())
+					Expect(up.APS.Alert.Body).To(Equal("testing"))
+					Expect(up.APS.Badge).To(Equal(p.APS.Badge))
+
+					ub, _ := json.Marshal(up)
+					Expect(ub).To(Equal(b))
+				})
+			})
+
+			Context("alert dictionary", func() {
+				It("should round trip", func() {
+					p := apns.NewPayload()
+					p.APS.Alert.Title = "Hello World!"
+					p.APS.Alert.Body = "This is a body"
+					p.APS.URLArgs = []string{"hello", "world"}
+
+					b, _ := json.Marshal(p)
+
+					up := apns.NewPayload()
+					Expect(json.Unmarshal(b, up)).To(BeNil())
+					Expect(up.APS.Alert.Title).To(Equal("Hello World!"))
+					Expect(up.APS.Badge.IsSet).To(BeFalse())
+
+					ub, _ := json.Marshal(up)
+					Expect(ub).To(Equal(b))
+				})
+			})
+
+			Context("MDM", func() {
+				It("should round trip", func() {
+					up := apns.NewPayload()
+					Expect(json.Unmarshal([]byte(`{"mdm":"00000000-1111-3333-4444-555555555555"}`), up)).To(BeNil())
+					Expect(up.MDM).To(Equal("00000000-1111-3333-4444-555555555555"))
+				})
+			})
 		})
 	})
 
@@ -311,6 +505,108 @@ var _ = Describe("Notifications", func() {
 					Expect(priority).To(Equal(uint8(10)))
 				})
 			})
+
+			Context("with HTTP/2 headers", func() {
+				It("should leave them out", func() {
+					n := apns.NewNotification()
+					n.Identifier = uint32(123123)
+					n.DeviceToken = "9999999999999999999999999999999999999999999999999999999999999999"
+					n.Priority = apns.PriorityImmediate
+
+					plain, _ := n.ToBinary()
+
+					n.CollapseID = "score"
+					n.PushType = apns.PushTypeAlert
+					n.Topic = "com.example.app"
+					n.APNSID = apns.NewAPNSID()
+
+					b, err := n.ToBinary()
+
+					Expect(err).To(BeNil())
+					Expect(b).To(Equal(plain))
+				})
+			})
+		})
+
+		Describe("#ValidateHeaders", func() {
+			Context("no headers", func() {
+				It("should be valid", func() {
+					Expect(apns.NewNotification().ValidateHeaders()).To(BeNil())
+				})
+			})
+
+			Context("valid headers", func() {
+				It("should be valid", func() {
+					n := apns.NewNotification()
+					n.CollapseID = strings.Repeat("a", apns.MaxCollapseIDLength)
+					n.PushType = apns.PushTypeVoIP
+					n.Topic = "com.example.app.voip"
+					n.APNSID = "123E4567-E89B-12D3-A456-42665544000A"
+
+					Expect(n.ValidateHeaders()).To(BeNil())
+				})
+			})
+
+			Context("long collapse ID", func() {
+				It("should return an error", func() {
+					n := apns.NewNotification()
+					n.CollapseID = strings.Repeat("a", apns.MaxCollapseIDLength+1)
+
+					Expect(n.ValidateHeaders()).To(Equal(apns.ErrCollapseIDTooLong))
+				})
+			})
+
+			Context("unknown push type", func() {
+				It("should return an error", func() {
+					n := apns.NewNotification()
+					n.PushType = "carrier-pigeon"
+
+					Expect(n.ValidateHeaders()).To(Equal(apns.ErrInvalidPushType))
+				})
+			})
+
+			Context("background push", func() {
+				It("should require priority 5", func() {
+					n := apns.NewNotification()
+					n.PushType = apns.PushTypeBackground
+					n.Priority = apns.PriorityImmediate
+
+					Expect(n.ValidateHeaders()).To(Equal(apns.ErrBackgroundPriority))
+
+					n.Priority = apns.PriorityPowerConserve
+					Expect(n.ValidateHeaders()).To(BeNil())
+				})
+			})
+
+			Context("voip push to the app topic", func() {
+				It("should return an error", func() {
+					n := apns.NewNotification()
+					n.PushType = apns.PushTypeVoIP
+					n.Topic = "com.example.app"
+
+					Expect(n.ValidateHeaders()).To(Equal(apns.ErrTopicPushTypeMismatch))
+				})
+			})
+
+			Context("bad APNs ID", func() {
+				It("should return an error", func() {
+					n := apns.NewNotification()
+					n.APNSID = "not-a-uuid"
+
+					Expect(n.ValidateHeaders()).To(Equal(apns.ErrInvalidAPNSID))
+				})
+			})
+		})
+
+		Describe(".NewAPNSID", func() {
+			It("should be a version 4 UUID", func() {
+				n := apns.NewNotification()
+				n.APNSID = apns.NewAPNSID()
+
+				Expect(n.ValidateHeaders()).To(BeNil())
+				Expect(n.APNSID[14]).To(Equal(byte('4')))
+				Expect(n.APNSID).NotTo(Equal(apns.NewAPNSID()))
+			})
 		})
 	})
 })
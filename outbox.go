@@ -0,0 +1,282 @@
+package apns
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Outbox persists notifications from the moment they're passed to Send until
+// they're known to be sent or rejected, so they can be sent again by a new
+// Client after a restart. Delivery is at least once: notifications that were
+// sent but not yet confirmed when the process died are sent twice. They're
+// confirmed after the client's SettleTime (DefaultOutboxSettleTime unless
+// set) or SettleCount, or once 50 later notifications were sent.
+type Outbox interface {
+	// Add persists n and returns an ID for it
+	Add(n Notification) (uint64, error)
+
+	// Sent marks a notification as delivered
+	Sent(id uint64) error
+
+	// Failed marks a notification that can't be delivered
+	Failed(id uint64, reason error) error
+
+	// Pending returns the notifications that are neither sent nor failed,
+	// oldest first
+	Pending() ([]OutboxEntry, error)
+}
+
+type OutboxEntry struct {
+	ID    uint64
+	Notif Notification
+}
+
+// outboxRecord is a line in a FileOutbox
+type outboxRecord struct {
+	Op    string              `json:"op"`
+	ID    uint64              `json:"id"`
+	Notif *outboxNotification `json:"notif,omitempty"`
+	Err   string              `json:"err,omitempty"`
+}
+
+const (
+	outboxAdd    = "add"
+	outboxSent   = "sent"
+	outboxFailed = "failed"
+)
+
+type outboxNotification struct {
+	ID          string     `json:"id,omitempty"`
+	DeviceToken string     `json:"token"`
+	Identifier  uint32     `json:"identifier,omitempty"`
+	Expiration  *time.Time `json:"expiration,omitempty"`
+	Priority    int        `json:"priority,omitempty"`
+	Payload     *Payload   `json:"payload,omitempty"`
+	CollapseID  string     `json:"collapse_id,omitempty"`
+	PushType    PushType   `json:"push_type,omitempty"`
+	Topic       string     `json:"topic,omitempty"`
+	APNSID      string     `json:"apns_id,omitempty"`
+}
+
+// FileOutbox is an Outbox kept in an append-only file of JSON records. Every
+// record is written straight to the file, so nothing is lost when the process
+// is killed. Call Compact now and then to drop finished notifications.
+type FileOutbox struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	nextID  uint64
+	pending map[uint64]Notification
+}
+
+// OpenFileOutbox opens the outbox in path, creating it if needed
+func OpenFileOutbox(path string) (*FileOutbox, error) {
+	o := &FileOutbox{
+		path:    path,
+		nextID:  1,
+		pending: map[uint64]Notification{},
+	}
+
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	o.f = f
+
+	return o, nil
+}
+
+func (o *FileOutbox) load() error {
+	f, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for s.Scan() {
+		var r outboxRecord
+
+		// A record cut short by a crash is skipped, the notification will
+		// just be missing or still pending
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			continue
+		}
+
+		switch r.Op {
+		case outboxAdd:
+			if r.Notif != nil {
+				o.pending[r.ID] = r.Notif.notification()
+			}
+		case outboxSent, outboxFailed:
+			delete(o.pending, r.ID)
+		}
+
+		if r.ID >= o.nextID {
+			o.nextID = r.ID + 1
+		}
+	}
+
+	return s.Err()
+}
+
+func (o *FileOutbox) write(r outboxRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.f.Write(append(b, '\n'))
+	return err
+}
+
+func (o *FileOutbox) Add(n Notification) (uint64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	id := o.nextID
+
+	on := newOutboxNotification(n)
+	if err := o.write(outboxRecord{Op: outboxAdd, ID: id, Notif: &on}); err != nil {
+		return 0, err
+	}
+
+	o.nextID++
+	o.pending[id] = n
+
+	return id, nil
+}
+
+func (o *FileOutbox) Sent(id uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.pending, id)
+	return o.write(outboxRecord{Op: outboxSent, ID: id})
+}
+
+func (o *FileOutbox) Failed(id uint64, reason error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	r := outboxRecord{Op: outboxFailed, ID: id}
+	if reason != nil {
+		r.Err = reason.Error()
+	}
+
+	delete(o.pending, id)
+	return o.write(r)
+}
+
+func (o *FileOutbox) Pending() ([]OutboxEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.entries(), nil
+}
+
+func (o *FileOutbox) entries() []OutboxEntry {
+	es := make([]OutboxEntry, 0, len(o.pending))
+	for id, n := range o.pending {
+		es = append(es, OutboxEntry{ID: id, Notif: n})
+	}
+
+	sort.Slice(es, func(i, j int) bool { return es[i].ID < es[j].ID })
+	return es
+}
+
+// Compact rewrites the file with only the pending notifications
+func (o *FileOutbox) Compact() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(o.path), filepath.Base(o.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range o.entries() {
+		on := newOutboxNotification(e.Notif)
+		if err := enc.Encode(outboxRecord{Op: outboxAdd, ID: e.ID, Notif: &on}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), o.path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	o.f.Close()
+	o.f = f
+
+	return nil
+}
+
+func (o *FileOutbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.f.Close()
+}
+
+func newOutboxNotification(n Notification) outboxNotification {
+	return outboxNotification{
+		ID:          n.ID,
+		DeviceToken: n.DeviceToken,
+		Identifier:  n.Identifier,
+		Expiration:  n.Expiration,
+		Priority:    n.Priority,
+		Payload:     n.Payload,
+		CollapseID:  n.CollapseID,
+		PushType:    n.PushType,
+		Topic:       n.Topic,
+		APNSID:      n.APNSID,
+	}
+}
+
+func (on outboxNotification) notification() Notification {
+	return Notification{
+		ID:          on.ID,
+		DeviceToken: on.DeviceToken,
+		Identifier:  on.Identifier,
+		Expiration:  on.Expiration,
+		Priority:    on.Priority,
+		Payload:     on.Payload,
+		CollapseID:  on.CollapseID,
+		PushType:    on.PushType,
+		Topic:       on.Topic,
+		APNSID:      on.APNSID,
+	}
+}
@@ -0,0 +1,134 @@
+package apns_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+var _ = Describe("FileOutbox", func() {
+	var dir, path string
+
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "outbox")
+		path = filepath.Join(dir, "outbox")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	newNotif := func(id string) apns.Notification {
+		n := apns.NewNotification()
+		n.ID = id
+		n.DeviceToken = "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+		n.Priority = apns.PriorityImmediate
+		n.Payload.APS.Alert.Body = "hello"
+		n.Payload.APS.Badge.Set(0)
+		n.Payload.SetCustomValue("link", "zombo://dot/com")
+		return n
+	}
+
+	Describe("#Pending", func() {
+		It("should return notifications not sent or failed", func() {
+			o, err := apns.OpenFileOutbox(path)
+			Expect(err).To(BeNil())
+			defer o.Close()
+
+			id1, _ := o.Add(newNotif("1"))
+			id2, _ := o.Add(newNotif("2"))
+			id3, _ := o.Add(newNotif("3"))
+
+			Expect(o.Sent(id1)).To(BeNil())
+			Expect(o.Failed(id3, errors.New("nope"))).To(BeNil())
+
+			es, err := o.Pending()
+			Expect(err).To(BeNil())
+			Expect(es).To(HaveLen(1))
+			Expect(es[0].ID).To(Equal(id2))
+			Expect(es[0].Notif.ID).To(Equal("2"))
+		})
+	})
+
+	Describe(".OpenFileOutbox", func() {
+		Context("existing outbox", func() {
+			It("should load the pending notifications", func() {
+				o, _ := apns.OpenFileOutbox(path)
+				id1, _ := o.Add(newNotif("1"))
+				o.Add(newNotif("2"))
+				o.Sent(id1)
+				o.Close()
+
+				o, err := apns.OpenFileOutbox(path)
+				Expect(err).To(BeNil())
+				defer o.Close()
+
+				es, _ := o.Pending()
+				Expect(es).To(HaveLen(1))
+
+				n := es[0].Notif
+				Expect(n.ID).To(Equal("2"))
+				Expect(n.DeviceToken).To(Equal(newNotif("2").DeviceToken))
+				Expect(n.Priority).To(Equal(apns.PriorityImmediate))
+
+				b, _ := n.ToBinary()
+				eb, _ := newNotif("2").ToBinary()
+				Expect(b).To(Equal(eb))
+
+				// IDs keep increasing
+				id3, _ := o.Add(newNotif("3"))
+				Expect(id3).To(BeNumerically(">", es[0].ID))
+			})
+		})
+
+		Context("record cut short", func() {
+			It("should skip it", func() {
+				o, _ := apns.OpenFileOutbox(path)
+				o.Add(newNotif("1"))
+				o.Close()
+
+				f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+				f.Write([]byte(`{"op":"add","id":2,"notif":{"tok`))
+				f.Close()
+
+				o, err := apns.OpenFileOutbox(path)
+				Expect(err).To(BeNil())
+				defer o.Close()
+
+				es, _ := o.Pending()
+				Expect(es).To(HaveLen(1))
+			})
+		})
+	})
+
+	Describe("#Compact", func() {
+		It("should only keep pending notifications", func() {
+			o, _ := apns.OpenFileOutbox(path)
+			for i := 0; i < 10; i++ {
+				id, _ := o.Add(newNotif("sent"))
+				o.Sent(id)
+			}
+			o.Add(newNotif("pending"))
+
+			before, _ := os.Stat(path)
+			Expect(o.Compact()).To(BeNil())
+			after, _ := os.Stat(path)
+			Expect(after.Size()).To(BeNumerically("<", before.Size()))
+
+			// Still writable after compacting
+			o.Add(newNotif("pending"))
+			o.Close()
+
+			o, _ = apns.OpenFileOutbox(path)
+			defer o.Close()
+
+			es, _ := o.Pending()
+			Expect(es).To(HaveLen(2))
+		})
+	})
+})
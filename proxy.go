@@ -0,0 +1,101 @@
+package apns
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyFromEnvironment returns the proxy the HTTPS_PROXY and NO_PROXY
+// environment variables name for the gateway gw, or nil for none
+func ProxyFromEnvironment(gw string) (*url.URL, error) {
+	return http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: gw}})
+}
+
+// contextDialer dials with a DialContext func, for golang.org/x/net/proxy
+type contextDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// dialProxy connects to addr through the proxy at u, using dial to reach the
+// proxy. TLS still runs end to end over the tunnel.
+func dialProxy(ctx context.Context, u *url.URL, dial contextDialer, network, addr string) (net.Conn, error) {
+	switch u.Scheme {
+	case "http":
+		return dialHTTPProxy(ctx, u, dial, network, addr)
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, dial)
+		if err != nil {
+			return nil, err
+		}
+
+		return d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	}
+
+	return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+}
+
+// dialHTTPProxy opens a tunnel to addr with an HTTP CONNECT request
+func dialHTTPProxy(ctx context.Context, u *url.URL, dial contextDialer, network, addr string) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	conn, err := dial(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Nothing comes through the tunnel before the TLS client hello, so the
+	// reader can't buffer any of it
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused connection: %s", res.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
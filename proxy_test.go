@@ -0,0 +1,174 @@
+package apns_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+// fakeProxy accepts a single tunnelled connection and records where it went
+type fakeProxy struct {
+	l       net.Listener
+	targets chan string
+}
+
+func newFakeProxy(handshake func(c net.Conn, br *bufio.Reader) (string, bool)) *fakeProxy {
+	l, _ := net.Listen("tcp", "localhost:0")
+	p := &fakeProxy{l: l, targets: make(chan string, 1)}
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		br := bufio.NewReader(c)
+		target, ok := handshake(c, br)
+		p.targets <- target
+		if !ok {
+			return
+		}
+
+		up, err := net.Dial("tcp", target)
+		if err != nil {
+			return
+		}
+		defer up.Close()
+
+		go io.Copy(up, br)
+		io.Copy(c, up)
+	}()
+
+	return p
+}
+
+func (p *fakeProxy) url(scheme string, user *url.Userinfo) *url.URL {
+	return &url.URL{Scheme: scheme, Host: p.l.Addr().String(), User: user}
+}
+
+// httpConnect handles a CONNECT request, requiring user:secret
+func httpConnect(c net.Conn, br *bufio.Reader) (string, bool) {
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodConnect {
+		return "", false
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if req.Header.Get("Proxy-Authorization") != "Basic "+auth {
+		io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return req.Host, false
+	}
+
+	io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, true
+}
+
+// socks5Connect handles an unauthenticated SOCKS5 CONNECT
+func socks5Connect(c net.Conn, br *bufio.Reader) (string, bool) {
+	hdr := make([]byte, 2)
+	io.ReadFull(br, hdr)
+	io.ReadFull(br, make([]byte, hdr[1]))
+	c.Write([]byte{5, 0})
+
+	req := make([]byte, 4)
+	io.ReadFull(br, req)
+
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	case 3:
+		l, _ := br.ReadByte()
+		name := make([]byte, l)
+		io.ReadFull(br, name)
+		host = string(name)
+	default:
+		return "", false
+	}
+
+	port := make([]byte, 2)
+	io.ReadFull(br, port)
+
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), true
+}
+
+var _ = Describe("Proxy", func() {
+	as := [][]serverAction{[]serverAction{serverAction{action: readAction, data: []byte{}}}}
+
+	Context("HTTP CONNECT", func() {
+		It("should tunnel TLS to the gateway", func(d Done) {
+			p := newFakeProxy(httpConnect)
+			defer p.l.Close()
+
+			withMockServer(as, func(s *mockTLSServer) {
+				conn, _ := apns.NewConn(s.Address(), DummyCert, DummyKey)
+				conn.Conf.InsecureSkipVerify = true
+				conn.Proxy = p.url("http", url.UserPassword("user", "secret"))
+
+				Expect(conn.Connect()).To(BeNil())
+				Expect(<-p.targets).To(Equal(s.Address()))
+
+				close(d)
+			})
+		})
+
+		It("should return an error when refused", func(d Done) {
+			p := newFakeProxy(httpConnect)
+			defer p.l.Close()
+
+			conn, _ := apns.NewConn(apns.SandboxGateway, DummyCert, DummyKey)
+			conn.Proxy = p.url("http", url.UserPassword("user", "wrong"))
+
+			err := conn.Connect()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("407"))
+
+			close(d)
+		})
+	})
+
+	Context("SOCKS5", func() {
+		It("should tunnel TLS to the gateway", func(d Done) {
+			p := newFakeProxy(socks5Connect)
+			defer p.l.Close()
+
+			withMockServer(as, func(s *mockTLSServer) {
+				conn, _ := apns.NewConn(s.Address(), DummyCert, DummyKey)
+				conn.Conf.InsecureSkipVerify = true
+				conn.Proxy = p.url("socks5", nil)
+
+				Expect(conn.Connect()).To(BeNil())
+				Expect(<-p.targets).To(Equal(s.Address()))
+
+				close(d)
+			})
+		})
+	})
+
+	Describe(".ProxyFromEnvironment", func() {
+		It("should return no proxy without HTTPS_PROXY", func() {
+			// The environment is only read once per process
+			if os.Getenv("HTTPS_PROXY") != "" || os.Getenv("https_proxy") != "" {
+				Skip("HTTPS_PROXY is set")
+			}
+
+			u, err := apns.ProxyFromEnvironment(apns.ProductionGateway)
+			Expect(err).To(BeNil())
+			Expect(u).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,239 @@
+package apns
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned by Client.Send when its RateLimiter doesn't
+// allow the notification
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+const (
+	// DefaultThrottleBackoff is how long a RateLimiter stays slowed down
+	// after Throttle
+	DefaultThrottleBackoff = 1 * time.Minute
+
+	// Throttle never slows a RateLimiter below this fraction of its rates
+	minThrottleFactor = 1.0 / 16
+
+	// Idle per token buckets are pruned once there are this many
+	maxTokenBuckets = 10000
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// fill adds the tokens accumulated since the last call, up to burst
+func (b *tokenBucket) fill(rate float64, burst int, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else if b.tokens += now.Sub(b.last).Seconds() * rate; b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+
+	b.last = now
+}
+
+// wait returns how long until a token is available
+func (b *tokenBucket) wait(rate float64) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// RateLimiterStats is returned by RateLimiter.Stats
+type RateLimiterStats struct {
+	// Notifications let through, and ones that were refused or had to wait
+	Allowed uint64
+	Limited uint64
+
+	// Times Throttle was called, and whether the limiter is slowed down
+	// right now
+	Throttles uint64
+	Throttled bool
+
+	// Device tokens with their own bucket
+	Tokens int
+}
+
+// RateLimiter limits notifications with token buckets: one shared by every
+// notification, and one for each device token so a bug looping on one user
+// can't flood them. A zero rate disables that bucket.
+type RateLimiter struct {
+	// Notifications per second, and how many can be sent at once
+	Rate  float64
+	Burst int
+
+	// Notifications per second, and at once, to the same device token
+	TokenRate  float64
+	TokenBurst int
+
+	// Block makes Client.Send wait for the limiter instead of returning
+	// ErrRateLimited
+	Block bool
+
+	// ThrottleBackoff overrides DefaultThrottleBackoff
+	ThrottleBackoff time.Duration
+
+	mu             sync.Mutex
+	global         tokenBucket
+	tokens         map[string]*tokenBucket
+	factor         float64
+	throttledUntil time.Time
+	stats          RateLimiterStats
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{Rate: rate, Burst: burst}
+}
+
+func (l *RateLimiter) throttleFactor(now time.Time) float64 {
+	if l.factor == 0 || now.After(l.throttledUntil) {
+		l.factor = 1
+	}
+
+	return l.factor
+}
+
+// reserve takes a token from both buckets if they both have one, or returns
+// how long until they do
+func (l *RateLimiter) reserve(token string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	factor := l.throttleFactor(now)
+
+	var wait time.Duration
+	var tb *tokenBucket
+
+	if l.Rate > 0 {
+		l.global.fill(l.Rate*factor, burst(l.Burst), now)
+		wait = l.global.wait(l.Rate * factor)
+	}
+
+	if l.TokenRate > 0 {
+		if l.tokens == nil {
+			l.tokens = map[string]*tokenBucket{}
+		}
+
+		if tb = l.tokens[token]; tb == nil {
+			l.pruneTokens(now, factor)
+
+			tb = &tokenBucket{}
+			l.tokens[token] = tb
+		}
+
+		tb.fill(l.TokenRate*factor, burst(l.TokenBurst), now)
+		if tw := tb.wait(l.TokenRate * factor); tw > wait {
+			wait = tw
+		}
+	}
+
+	if wait > 0 {
+		return wait
+	}
+
+	if l.Rate > 0 {
+		l.global.tokens--
+	}
+	if tb != nil {
+		tb.tokens--
+	}
+
+	l.stats.Allowed++
+	return 0
+}
+
+// pruneTokens forgets the buckets that have filled up again, since they're
+// the same as a new bucket
+func (l *RateLimiter) pruneTokens(now time.Time, factor float64) {
+	if len(l.tokens) < maxTokenBuckets {
+		return
+	}
+
+	for token, tb := range l.tokens {
+		if tb.fill(l.TokenRate*factor, burst(l.TokenBurst), now); tb.tokens >= float64(burst(l.TokenBurst)) {
+			delete(l.tokens, token)
+		}
+	}
+}
+
+func burst(b int) int {
+	if b < 1 {
+		return 1
+	}
+
+	return b
+}
+
+// Allow reports whether a notification to token can be sent now, and counts
+// it against the limits if so
+func (l *RateLimiter) Allow(token string) bool {
+	if l.reserve(token, time.Now()) > 0 {
+		l.limited()
+		return false
+	}
+
+	return true
+}
+
+// Wait blocks until a notification to token can be sent, and counts it
+// against the limits
+func (l *RateLimiter) Wait(token string) {
+	wait := l.reserve(token, time.Now())
+	if wait > 0 {
+		l.limited()
+	}
+
+	for wait > 0 {
+		time.Sleep(wait)
+		wait = l.reserve(token, time.Now())
+	}
+}
+
+func (l *RateLimiter) limited() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stats.Limited++
+}
+
+// Throttle halves the limiter's rates until ThrottleBackoff passes without
+// another call. Client calls it when the gateway keeps dropping the
+// connection, and it can be called on other signs of sending too fast.
+func (l *RateLimiter) Throttle() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	if l.factor = l.throttleFactor(now) / 2; l.factor < minThrottleFactor {
+		l.factor = minThrottleFactor
+	}
+
+	backoff := l.ThrottleBackoff
+	if backoff == 0 {
+		backoff = DefaultThrottleBackoff
+	}
+
+	l.throttledUntil = now.Add(backoff)
+	l.stats.Throttles++
+}
+
+// Stats returns the limiter's counters since it was created
+func (l *RateLimiter) Stats() RateLimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := l.stats
+	stats.Throttled = time.Now().Before(l.throttledUntil)
+	stats.Tokens = len(l.tokens)
+
+	return stats
+}
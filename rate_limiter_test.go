@@ -0,0 +1,87 @@
+package apns_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+var _ = Describe("RateLimiter", func() {
+	t1 := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+	t2 := "00a1a4b7294fcfbc5293f63d4298fcecd9c20a893befd45adceead5fc92d3319"
+
+	Describe("#Allow", func() {
+		Context("global limit", func() {
+			It("should allow a burst and then limit", func() {
+				l := apns.NewRateLimiter(1, 2)
+
+				Expect(l.Allow(t1)).To(BeTrue())
+				Expect(l.Allow(t2)).To(BeTrue())
+				Expect(l.Allow(t1)).To(BeFalse())
+
+				stats := l.Stats()
+				Expect(stats.Allowed).To(Equal(uint64(2)))
+				Expect(stats.Limited).To(Equal(uint64(1)))
+			})
+		})
+
+		Context("per token limit", func() {
+			It("should only limit that token", func() {
+				l := &apns.RateLimiter{TokenRate: 1, TokenBurst: 1}
+
+				Expect(l.Allow(t1)).To(BeTrue())
+				Expect(l.Allow(t1)).To(BeFalse())
+				Expect(l.Allow(t2)).To(BeTrue())
+				Expect(l.Stats().Tokens).To(Equal(2))
+			})
+		})
+
+		Context("after waiting", func() {
+			It("should allow again", func() {
+				l := apns.NewRateLimiter(20, 1)
+
+				Expect(l.Allow(t1)).To(BeTrue())
+				Expect(l.Allow(t1)).To(BeFalse())
+
+				time.Sleep(60 * time.Millisecond)
+				Expect(l.Allow(t1)).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("#Wait", func() {
+		It("should block until allowed", func() {
+			l := apns.NewRateLimiter(20, 1)
+			l.Wait(t1)
+
+			start := time.Now()
+			l.Wait(t1)
+
+			Expect(time.Since(start)).To(BeNumerically(">=", 40*time.Millisecond))
+			Expect(l.Stats().Limited).To(Equal(uint64(1)))
+		})
+	})
+
+	Describe("#Throttle", func() {
+		It("should slow down until the backoff passes", func() {
+			l := apns.NewRateLimiter(20, 1)
+			l.ThrottleBackoff = 200 * time.Millisecond
+
+			l.Throttle()
+			l.Throttle()
+			Expect(l.Stats().Throttled).To(BeTrue())
+			Expect(l.Stats().Throttles).To(Equal(uint64(2)))
+
+			// 5 per second while throttled
+			Expect(l.Allow(t1)).To(BeTrue())
+			time.Sleep(60 * time.Millisecond)
+			Expect(l.Allow(t1)).To(BeFalse())
+
+			time.Sleep(200 * time.Millisecond)
+			Expect(l.Stats().Throttled).To(BeFalse())
+			Expect(l.Allow(t1)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,251 @@
+package apns
+
+import (
+	"container/heap"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrExpiresBeforeSend is returned by Scheduler.Schedule when the
+	// notification's Expiration is before the time it would be sent
+	ErrExpiresBeforeSend = errors.New("notification expires before it is sent")
+
+	// ErrAlreadyScheduled is returned by Scheduler.Schedule when a
+	// notification with the same ID is waiting to be sent
+	ErrAlreadyScheduled = errors.New("notification already scheduled")
+)
+
+type scheduledNotif struct {
+	n     Notification
+	at    time.Time
+	seq   uint64
+	index int
+}
+
+// scheduleQueue is a heap of notifications ordered by send time, and then by
+// the order they were scheduled in
+type scheduleQueue []*scheduledNotif
+
+func (q scheduleQueue) Len() int { return len(q) }
+
+func (q scheduleQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+
+	return q[i].at.Before(q[j].at)
+}
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(v interface{}) {
+	sn := v.(*scheduledNotif)
+	sn.index = len(*q)
+	*q = append(*q, sn)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	sn := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return sn
+}
+
+// Scheduler sends notifications through a Client at a later time.
+// Notifications whose Expiration passes before they're sent are dropped.
+type Scheduler struct {
+	Client *Client
+
+	// OnExpired is optional, and is called with every notification dropped
+	// because it expired
+	OnExpired func(n Notification)
+
+	// OnSendError is optional, and is called with every notification the
+	// Client rejected when its time came. They're logged when it's nil.
+	OnSendError func(n Notification, err error)
+
+	// deliver replaces Client.Send, for the client's own scheduler
+	deliver func(n Notification) error
+
+	mu    sync.Mutex
+	queue scheduleQueue
+	byID  map[string]*scheduledNotif
+	seq   uint64
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewScheduler starts a scheduler sending through c. Call Stop when done.
+func NewScheduler(c *Client) *Scheduler {
+	s := &Scheduler{
+		Client: c,
+		byID:   map[string]*scheduledNotif{},
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+// Schedule sends n at the given time. Notifications with an ID can be
+// cancelled with Cancel.
+func (s *Scheduler) Schedule(n Notification, at time.Time) error {
+	if n.Expiration != nil && !n.Expiration.After(at) {
+		return ErrExpiresBeforeSend
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.byID[n.ID]; ok && n.ID != "" {
+		return ErrAlreadyScheduled
+	}
+
+	s.seq++
+	sn := &scheduledNotif{n: n, at: at, seq: s.seq}
+	heap.Push(&s.queue, sn)
+
+	if n.ID != "" {
+		s.byID[n.ID] = sn
+	}
+
+	s.notify()
+	return nil
+}
+
+// Cancel removes the notification with the given ID, and reports whether it
+// was still waiting to be sent
+func (s *Scheduler) Cancel(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sn, ok := s.byID[id]
+	if !ok {
+		return false
+	}
+
+	heap.Remove(&s.queue, sn.index)
+	delete(s.byID, id)
+
+	s.notify()
+	return true
+}
+
+// Len returns the number of notifications waiting to be sent
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.queue)
+}
+
+// Stop stops sending and returns the notifications that were still waiting
+func (s *Scheduler) Stop() []Notification {
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns := make([]Notification, 0, len(s.queue))
+	for len(s.queue) > 0 {
+		ns = append(ns, heap.Pop(&s.queue).(*scheduledNotif).n)
+	}
+	s.byID = map[string]*scheduledNotif{}
+
+	return ns
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due pops the notifications whose time has come, and returns how long until
+// the next one, or -1 if there's none
+func (s *Scheduler) due(now time.Time) ([]Notification, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns := []Notification{}
+	for len(s.queue) > 0 && !s.queue[0].at.After(now) {
+		sn := heap.Pop(&s.queue).(*scheduledNotif)
+		if sn.n.ID != "" {
+			delete(s.byID, sn.n.ID)
+		}
+
+		ns = append(ns, sn.n)
+	}
+
+	if len(s.queue) == 0 {
+		return ns, -1
+	}
+
+	return ns, s.queue[0].at.Sub(now)
+}
+
+func (s *Scheduler) send(n Notification) {
+	if n.Expiration != nil && !n.Expiration.After(time.Now()) {
+		if s.OnExpired != nil {
+			s.OnExpired(n)
+		}
+		return
+	}
+
+	deliver := s.Client.Send
+	if s.deliver != nil {
+		deliver = s.deliver
+	}
+
+	err := deliver(n)
+	switch {
+	case err == nil:
+	case s.OnSendError != nil:
+		s.OnSendError(n, err)
+	default:
+		log.Println("err sending scheduled notification", err.Error())
+	}
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	for {
+		ns, next := s.due(time.Now())
+		for _, n := range ns {
+			s.send(n)
+		}
+
+		var t *time.Timer
+		var timeout <-chan time.Time
+		if next >= 0 {
+			t = time.NewTimer(next)
+			timeout = t.C
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+		case <-timeout:
+		}
+
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package apns_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+// slowTokenStore takes its time to reject every token
+type slowTokenStore struct {
+	delay time.Duration
+}
+
+func (s slowTokenStore) InvalidateToken(token string, t time.Time) error { return nil }
+func (s slowTokenStore) TokenSucceeded(token string, t time.Time) error  { return nil }
+func (s slowTokenStore) LastSuccess(token string) (time.Time, bool, error) {
+	return time.Time{}, false, nil
+}
+
+func (s slowTokenStore) TokenValid(token string) (bool, error) {
+	time.Sleep(s.delay)
+	return false, nil
+}
+
+var _ = Describe("Scheduler", func() {
+	tok := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+	Describe("#Schedule", func() {
+		Context("expires before send time", func() {
+			It("should return an error", func() {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+				s := apns.NewScheduler(c)
+				defer s.Stop()
+
+				exp := time.Now().Add(time.Minute)
+				n := apns.Notification{DeviceToken: tok, Expiration: &exp}
+
+				Expect(s.Schedule(n, time.Now().Add(time.Hour))).To(Equal(apns.ErrExpiresBeforeSend))
+			})
+		})
+
+		Context("same ID twice", func() {
+			It("should return an error", func() {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+				s := apns.NewScheduler(c)
+				defer s.Stop()
+
+				n := apns.Notification{ID: "campaign:1", DeviceToken: tok}
+
+				Expect(s.Schedule(n, time.Now().Add(time.Hour))).To(BeNil())
+				Expect(s.Schedule(n, time.Now().Add(time.Hour))).To(Equal(apns.ErrAlreadyScheduled))
+				Expect(s.Len()).To(Equal(1))
+			})
+		})
+
+		Context("due notifications", func() {
+			n1 := apns.Notification{Identifier: 1, DeviceToken: tok}
+			n2 := apns.Notification{Identifier: 2, DeviceToken: tok}
+
+			n1b, _ := n1.ToBinary()
+			n2b, _ := n2.ToBinary()
+
+			It("should send them in order", func(d Done) {
+				mockDone := make(chan interface{})
+				scheduled := time.Now()
+
+				as := [][]serverAction{
+					[]serverAction{
+						serverAction{action: readAction, data: []byte{}},
+						serverAction{action: readAction, data: make([]byte, len(n1b)), cb: func(a serverAction) {
+							Expect(a.data).To(Equal(n1b))
+							Expect(time.Since(scheduled)).To(BeNumerically(">=", 50*time.Millisecond))
+						}},
+						serverAction{action: readAction, data: make([]byte, len(n2b)), cb: func(a serverAction) {
+							Expect(a.data).To(Equal(n2b))
+
+							close(mockDone)
+							close(d)
+						}},
+					},
+				}
+
+				withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+					c.Conn.Conf.InsecureSkipVerify = true
+
+					sch := apns.NewScheduler(c)
+					sch.Schedule(n2, scheduled.Add(100*time.Millisecond))
+					sch.Schedule(n1, scheduled.Add(50*time.Millisecond))
+				})
+			})
+		})
+
+		Context("expired by send time", func() {
+			It("should drop and report it", func(d Done) {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+				c.TokenStore = slowTokenStore{100 * time.Millisecond}
+
+				s := apns.NewScheduler(c)
+
+				expired := make(chan apns.Notification)
+				s.OnExpired = func(n apns.Notification) { expired <- n }
+				s.OnSendError = func(n apns.Notification, err error) {}
+
+				// Sending the first notification holds up the second until
+				// it has expired
+				exp := time.Now().Add(50 * time.Millisecond)
+				Expect(s.Schedule(apns.Notification{DeviceToken: tok}, time.Now())).To(BeNil())
+				Expect(s.Schedule(apns.Notification{ID: "late", DeviceToken: tok, Expiration: &exp}, time.Now().Add(10*time.Millisecond))).To(BeNil())
+
+				Expect((<-expired).ID).To(Equal("late"))
+				s.Stop()
+				close(d)
+			})
+		})
+	})
+
+	Describe("sending", func() {
+		Context("rejected by the client", func() {
+			It("should report it", func(d Done) {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+				c.TokenStore = slowTokenStore{}
+
+				s := apns.NewScheduler(c)
+
+				type failure struct {
+					n   apns.Notification
+					err error
+				}
+				failed := make(chan failure)
+				s.OnSendError = func(n apns.Notification, err error) { failed <- failure{n, err} }
+
+				Expect(s.Schedule(apns.Notification{ID: "a", DeviceToken: tok}, time.Now())).To(BeNil())
+
+				f := <-failed
+				Expect(f.n.ID).To(Equal("a"))
+				Expect(f.err).To(Equal(apns.ErrTokenInvalidated))
+
+				s.Stop()
+				close(d)
+			})
+		})
+	})
+
+	Describe("#Cancel", func() {
+		It("should remove the notification", func() {
+			c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+			s := apns.NewScheduler(c)
+
+			s.Schedule(apns.Notification{ID: "a", DeviceToken: tok}, time.Now().Add(time.Hour))
+			s.Schedule(apns.Notification{ID: "b", DeviceToken: tok}, time.Now().Add(time.Hour))
+
+			Expect(s.Cancel("a")).To(BeTrue())
+			Expect(s.Cancel("a")).To(BeFalse())
+			Expect(s.Cancel("missing")).To(BeFalse())
+
+			left := s.Stop()
+			Expect(left).To(HaveLen(1))
+			Expect(left[0].ID).To(Equal("b"))
+		})
+	})
+})
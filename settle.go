@@ -0,0 +1,85 @@
+package apns
+
+import (
+	"container/list"
+	"time"
+)
+
+const (
+	// Sentinels are written to this token, which APNs rejects as invalid
+	sentinelToken = "0000000000000000000000000000000000000000000000000000000000000000"
+
+	// Settled notifications and due sentinels are checked for at most this
+	// often
+	minSettleTick = 10 * time.Millisecond
+)
+
+// settleTick is how often to check for settled notifications and due
+// sentinels, or 0 if neither is configured
+func (c *Client) settleTick() time.Duration {
+	d := c.SettleTime
+	if c.SentinelInterval > 0 && (d == 0 || c.SentinelInterval < d) {
+		d = c.SentinelInterval
+	}
+
+	if d /= 4; d > 0 && d < minSettleTick {
+		d = minSettleTick
+	}
+
+	return d
+}
+
+// settle confirms the notifications that went SettleTime, or SettleCount
+// later notifications, without an error response. It stops at the first
+// notification that hasn't been flushed. They stay in the buffer, marked as
+// settled, so their identifiers aren't reused while APNs could still report
+// an error for them.
+func (c *Client) settle(b *buffer, now time.Time, unflushed *list.Element) {
+	later := b.Len()
+
+	for e := b.Front(); e != nil && e != unflushed; e = e.Next() {
+		later--
+
+		n, _ := e.Value.(Notification)
+		if n.settled {
+			continue
+		}
+
+		byTime := c.SettleTime > 0 && now.Sub(n.sentAt) >= c.SettleTime
+		byCount := c.SettleCount > 0 && later >= c.SettleCount
+		if !byTime && !byCount {
+			return
+		}
+
+		c.succeeded(n)
+
+		n.settled = true
+		e.Value = n
+	}
+}
+
+// sentinelDue reports whether the last notification written is unconfirmed,
+// and SentinelInterval has passed since the last sentinel
+func (c *Client) sentinelDue(b *buffer, now time.Time) bool {
+	if c.SentinelInterval == 0 || now.Sub(c.lastSentinel) < c.SentinelInterval {
+		return false
+	}
+
+	last := b.Back()
+	if last == nil {
+		return false
+	}
+
+	n, _ := last.Value.(Notification)
+	return !n.sentinel && !n.settled
+}
+
+func (c *Client) newSentinel(now time.Time) Notification {
+	c.lastSentinel = now
+
+	return Notification{
+		DeviceToken: sentinelToken,
+		Payload:     NewPayload(),
+		sentinel:    true,
+	}
+}
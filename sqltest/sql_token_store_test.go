@@ -0,0 +1,108 @@
+package sqltest_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+	_ "modernc.org/sqlite"
+)
+
+var _ = Describe("SQLTokenStore", func() {
+	tok := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+	var dir string
+	var s *apns.SQLTokenStore
+
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "tokens")
+
+		db, err := sql.Open("sqlite", filepath.Join(dir, "tokens.db"))
+		if err != nil {
+			Skip("sqlite isn't available: " + err.Error())
+		}
+		if err := db.Ping(); err != nil {
+			Skip("sqlite isn't available: " + err.Error())
+		}
+
+		s = apns.NewSQLTokenStore(db, "tokens")
+		Expect(s.CreateTable()).To(BeNil())
+	})
+
+	AfterEach(func() {
+		if s != nil {
+			s.DB.Close()
+		}
+		os.RemoveAll(dir)
+	})
+
+	for name, placeholder := range map[string]func(int) string{
+		"?":  nil,
+		"$n": apns.DollarPlaceholder,
+	} {
+		placeholder := placeholder
+
+		Context("with "+name+" parameters", func() {
+			BeforeEach(func() {
+				s.Placeholder = placeholder
+			})
+
+			It("should keep track of invalidated tokens", func() {
+				valid, err := s.TokenValid(tok)
+				Expect(err).To(BeNil())
+				Expect(valid).To(BeTrue())
+
+				Expect(s.InvalidateToken(tok, time.Unix(100, 0))).To(BeNil())
+
+				valid, err = s.TokenValid(tok)
+				Expect(err).To(BeNil())
+				Expect(valid).To(BeFalse())
+
+				Expect(s.RegisterToken(tok, time.Unix(200, 0))).To(BeNil())
+
+				valid, err = s.TokenValid(tok)
+				Expect(err).To(BeNil())
+				Expect(valid).To(BeTrue())
+			})
+
+			It("should ignore invalidations from before the registration", func() {
+				Expect(s.RegisterToken(tok, time.Unix(200, 0))).To(BeNil())
+				Expect(s.InvalidateToken(tok, time.Unix(100, 0))).To(BeNil())
+
+				valid, err := s.TokenValid(tok)
+				Expect(err).To(BeNil())
+				Expect(valid).To(BeTrue())
+			})
+
+			It("should return the last success", func() {
+				_, ok, err := s.LastSuccess(tok)
+				Expect(err).To(BeNil())
+				Expect(ok).To(BeFalse())
+
+				Expect(s.TokenSucceeded(tok, time.Unix(100, 0))).To(BeNil())
+				Expect(s.TokenSucceeded(tok, time.Unix(150, 0))).To(BeNil())
+
+				t, ok, err := s.LastSuccess(tok)
+				Expect(err).To(BeNil())
+				Expect(ok).To(BeTrue())
+				Expect(t).To(Equal(time.Unix(150, 0)))
+			})
+		})
+	}
+
+	Describe("#CreateTable", func() {
+		It("should keep an existing table", func() {
+			Expect(s.InvalidateToken(tok, time.Unix(100, 0))).To(BeNil())
+			Expect(s.CreateTable()).To(BeNil())
+
+			valid, err := s.TokenValid(tok)
+			Expect(err).To(BeNil())
+			Expect(valid).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package sqltest_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSqltest(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SQL Suite")
+}
@@ -0,0 +1,323 @@
+package apns
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrTokenInvalidated is returned by Client.Send for device tokens its
+// TokenStore knows to be invalid
+var ErrTokenInvalidated = errors.New("device token has been invalidated")
+
+// TokenStore keeps track of which device tokens are still valid. Client and
+// Feedback invalidate tokens APNs rejects, and Client skips sending to them.
+type TokenStore interface {
+	TokenInvalidator
+
+	// TokenValid reports whether pushes should still be sent to token.
+	// Unknown tokens are valid.
+	TokenValid(token string) (bool, error)
+
+	// TokenSucceeded records that a push to token was accepted at t
+	TokenSucceeded(token string, t time.Time) error
+
+	// LastSuccess returns when a push to token was last accepted, and false
+	// if none was
+	LastSuccess(token string) (time.Time, bool, error)
+}
+
+type tokenState struct {
+	registered  time.Time
+	invalidated time.Time
+	lastSuccess time.Time
+}
+
+// MemoryTokenStore is a TokenStore kept in memory
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*tokenState
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: map[string]*tokenState{}}
+}
+
+func (s *MemoryTokenStore) state(token string) *tokenState {
+	ts, ok := s.tokens[token]
+	if !ok {
+		ts = &tokenState{}
+		s.tokens[token] = ts
+	}
+
+	return ts
+}
+
+// RegisterToken records that the app registered token at t, which makes it
+// valid again
+func (s *MemoryTokenStore) RegisterToken(token string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := s.state(token)
+	ts.registered = t
+	ts.invalidated = time.Time{}
+	return nil
+}
+
+// InvalidateToken marks token invalid, unless it was registered after t
+func (s *MemoryTokenStore) InvalidateToken(token string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := s.state(token)
+	if ts.registered.After(t) {
+		return nil
+	}
+
+	ts.invalidated = t
+	return nil
+}
+
+func (s *MemoryTokenStore) TokenValid(token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts, ok := s.tokens[token]
+	return !ok || ts.invalidated.IsZero(), nil
+}
+
+func (s *MemoryTokenStore) TokenSucceeded(token string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state(token).lastSuccess = t
+	return nil
+}
+
+func (s *MemoryTokenStore) LastSuccess(token string) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts, ok := s.tokens[token]
+	if !ok || ts.lastSuccess.IsZero() {
+		return time.Time{}, false, nil
+	}
+
+	return ts.lastSuccess, true, nil
+}
+
+// successRecorder passes successes on to a TokenStore from its own goroutine,
+// so the client's write loop doesn't wait for it. Successes that come in
+// while it's busy are recorded together, with the latest time per token.
+type successRecorder struct {
+	store TokenStore
+
+	mu      sync.Mutex
+	pending map[string]time.Time
+	wake    chan struct{}
+}
+
+func newSuccessRecorder(store TokenStore) *successRecorder {
+	r := &successRecorder{
+		store:   store,
+		pending: map[string]time.Time{},
+		wake:    make(chan struct{}, 1),
+	}
+	go r.run()
+
+	return r
+}
+
+func (r *successRecorder) record(token string, t time.Time) {
+	r.mu.Lock()
+	r.pending[token] = t
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *successRecorder) run() {
+	for range r.wake {
+		r.mu.Lock()
+		batch := r.pending
+		r.pending = map[string]time.Time{}
+		r.mu.Unlock()
+
+		for token, t := range batch {
+			if err := r.store.TokenSucceeded(token, t); err != nil {
+				log.Println("err recording apns success", err.Error())
+			}
+		}
+	}
+}
+
+// DollarPlaceholder numbers query parameters the way PostgreSQL expects
+func DollarPlaceholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+// SQLTokenStore is a TokenStore kept in a database table. Times are stored as
+// Unix timestamps, with 0 meaning never.
+type SQLTokenStore struct {
+	DB    *sql.DB
+	Table string
+
+	// Placeholder formats the nth (starting at 1) query parameter. Queries
+	// use "?" when it's nil.
+	Placeholder func(n int) string
+}
+
+func NewSQLTokenStore(db *sql.DB, table string) *SQLTokenStore {
+	return &SQLTokenStore{DB: db, Table: table}
+}
+
+// query replaces the "?" parameters in q with the configured placeholder
+func (s *SQLTokenStore) query(q string) string {
+	if s.Placeholder == nil {
+		return q
+	}
+
+	b := []byte{}
+	n := 0
+	for i := 0; i < len(q); i++ {
+		if q[i] == '?' {
+			n++
+			b = append(b, s.Placeholder(n)...)
+		} else {
+			b = append(b, q[i])
+		}
+	}
+
+	return string(b)
+}
+
+func (s *SQLTokenStore) exec(q string, args ...interface{}) (int64, error) {
+	return s.execWith(s.DB, q, args...)
+}
+
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *SQLTokenStore) execWith(db sqlExecer, q string, args ...interface{}) (int64, error) {
+	res, err := db.Exec(s.query(fmt.Sprintf(q, s.Table)), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// upsert runs update, and inserts the token with insert if it wasn't there.
+// The client and a feedback poller can both write a new token, so when the
+// insert fails because the other one inserted it first, it starts over.
+func (s *SQLTokenStore) upsert(token string, update string, updateArgs []interface{}, insert string, insertArgs []interface{}) error {
+	err := s.upsertTx(token, update, updateArgs, insert, insertArgs)
+	if err != nil {
+		err = s.upsertTx(token, update, updateArgs, insert, insertArgs)
+	}
+
+	return err
+}
+
+func (s *SQLTokenStore) upsertTx(token string, update string, updateArgs []interface{}, insert string, insertArgs []interface{}) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	n, err := s.execWith(tx, update, updateArgs...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if n == 0 {
+		var exists int
+		err = tx.QueryRow(s.query(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE token = ?", s.Table)), token).Scan(&exists)
+		if err == nil && exists == 0 {
+			_, err = s.execWith(tx, insert, insertArgs...)
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CreateTable creates the table if it doesn't exist yet
+func (s *SQLTokenStore) CreateTable() error {
+	_, err := s.exec(`CREATE TABLE IF NOT EXISTS %s (
+		token VARCHAR(200) NOT NULL PRIMARY KEY,
+		registered_at BIGINT NOT NULL DEFAULT 0,
+		invalidated_at BIGINT NOT NULL DEFAULT 0,
+		last_success_at BIGINT NOT NULL DEFAULT 0
+	)`)
+	return err
+}
+
+// RegisterToken records that the app registered token at t, which makes it
+// valid again
+func (s *SQLTokenStore) RegisterToken(token string, t time.Time) error {
+	return s.upsert(token,
+		"UPDATE %s SET registered_at = ?, invalidated_at = 0 WHERE token = ?",
+		[]interface{}{t.Unix(), token},
+		"INSERT INTO %s (token, registered_at) VALUES (?, ?)",
+		[]interface{}{token, t.Unix()},
+	)
+}
+
+// InvalidateToken marks token invalid, unless it was registered after t
+func (s *SQLTokenStore) InvalidateToken(token string, t time.Time) error {
+	return s.upsert(token,
+		"UPDATE %s SET invalidated_at = ? WHERE token = ? AND registered_at <= ?",
+		[]interface{}{t.Unix(), token, t.Unix()},
+		"INSERT INTO %s (token, invalidated_at) VALUES (?, ?)",
+		[]interface{}{token, t.Unix()},
+	)
+}
+
+func (s *SQLTokenStore) TokenValid(token string) (bool, error) {
+	var invalidated int64
+	err := s.DB.QueryRow(s.query(fmt.Sprintf("SELECT invalidated_at FROM %s WHERE token = ?", s.Table)), token).Scan(&invalidated)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return invalidated == 0, nil
+}
+
+func (s *SQLTokenStore) TokenSucceeded(token string, t time.Time) error {
+	return s.upsert(token,
+		"UPDATE %s SET last_success_at = ? WHERE token = ?",
+		[]interface{}{t.Unix(), token},
+		"INSERT INTO %s (token, last_success_at) VALUES (?, ?)",
+		[]interface{}{token, t.Unix()},
+	)
+}
+
+func (s *SQLTokenStore) LastSuccess(token string) (time.Time, bool, error) {
+	var ts int64
+	err := s.DB.QueryRow(s.query(fmt.Sprintf("SELECT last_success_at FROM %s WHERE token = ?", s.Table)), token).Scan(&ts)
+	if err == sql.ErrNoRows || (err == nil && ts == 0) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return time.Unix(ts, 0), true, nil
+}
@@ -0,0 +1,397 @@
+package apns_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+// fakeDB is a database/sql driver keeping one token table in memory. It
+// understands the statements SQLTokenStore makes, with ? or $n parameters,
+// and records them.
+type fakeDB struct {
+	mu      sync.Mutex
+	rows    map[string]*fakeRow
+	queries []string
+
+	// beforeInsert is called before an INSERT runs, e.g. to insert the token
+	// first like another writer would
+	beforeInsert func(db *fakeDB)
+}
+
+type fakeRow struct {
+	registered, invalidated, lastSuccess int64
+}
+
+var fakeParam = regexp.MustCompile(`\$\d+`)
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{rows: map[string]*fakeRow{}}
+}
+
+func (db *fakeDB) Open(name string) (driver.Conn, error)            { return fakeConn{db}, nil }
+func (db *fakeDB) Connect(ctx context.Context) (driver.Conn, error) { return fakeConn{db}, nil }
+func (db *fakeDB) Driver() driver.Driver                            { return db }
+
+func (db *fakeDB) Queries() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return append([]string{}, db.queries...)
+}
+
+func (db *fakeDB) insert(token string, r fakeRow) error {
+	if _, ok := db.rows[token]; ok {
+		return errors.New("duplicate key value violates unique constraint")
+	}
+
+	db.rows[token] = &r
+	return nil
+}
+
+func (db *fakeDB) run(q string, args []driver.Value) (int64, [][]driver.Value, error) {
+	beforeInsert := db.beforeInsert
+	if strings.HasPrefix(q, "INSERT") && beforeInsert != nil {
+		db.beforeInsert = nil
+		beforeInsert(db)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.queries = append(db.queries, q)
+	q = fakeParam.ReplaceAllString(q, "?")
+
+	switch {
+	case strings.HasPrefix(q, "CREATE TABLE"):
+		return 0, nil, nil
+	case strings.HasPrefix(q, "UPDATE"):
+		token, _ := args[1].(string)
+		r, ok := db.rows[token]
+		if !ok {
+			return 0, nil, nil
+		}
+
+		t := args[0].(int64)
+		switch {
+		case strings.Contains(q, "SET registered_at"):
+			r.registered, r.invalidated = t, 0
+		case strings.Contains(q, "SET invalidated_at"):
+			if r.registered > args[2].(int64) {
+				return 0, nil, nil
+			}
+			r.invalidated = t
+		case strings.Contains(q, "SET last_success_at"):
+			r.lastSuccess = t
+		}
+
+		return 1, nil, nil
+	case strings.HasPrefix(q, "INSERT"):
+		token, _ := args[0].(string)
+		t := args[1].(int64)
+
+		switch {
+		case strings.Contains(q, "(token, registered_at)"):
+			return 1, nil, db.insert(token, fakeRow{registered: t})
+		case strings.Contains(q, "(token, invalidated_at)"):
+			return 1, nil, db.insert(token, fakeRow{invalidated: t})
+		default:
+			return 1, nil, db.insert(token, fakeRow{lastSuccess: t})
+		}
+	case strings.HasPrefix(q, "SELECT COUNT(*)"):
+		_, ok := db.rows[args[0].(string)]
+		if ok {
+			return 0, [][]driver.Value{{int64(1)}}, nil
+		}
+		return 0, [][]driver.Value{{int64(0)}}, nil
+	case strings.HasPrefix(q, "SELECT"):
+		r, ok := db.rows[args[0].(string)]
+		if !ok {
+			return 0, nil, nil
+		}
+
+		if strings.Contains(q, "invalidated_at") {
+			return 0, [][]driver.Value{{r.invalidated}}, nil
+		}
+		return 0, [][]driver.Value{{r.lastSuccess}}, nil
+	}
+
+	return 0, nil, errors.New("unexpected query: " + q)
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(q string) (driver.Stmt, error) { return fakeStmt{c.db, q}, nil }
+func (c fakeConn) Close() error                          { return nil }
+
+// Begin starts a transaction. SQLTokenStore makes at most one change in one,
+// and failed statements change nothing, so there's nothing to roll back.
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db *fakeDB
+	q  string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	n, _, err := s.db.run(s.q, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return driver.RowsAffected(n), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	_, rows, err := s.db.run(s.q, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fakeRows{rows: rows}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return []string{"value"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var _ = Describe("MemoryTokenStore", func() {
+	tok := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+	Describe("#TokenValid", func() {
+		Context("unknown token", func() {
+			It("should be valid", func() {
+				s := apns.NewMemoryTokenStore()
+
+				valid, err := s.TokenValid(tok)
+				Expect(err).To(BeNil())
+				Expect(valid).To(BeTrue())
+			})
+		})
+
+		Context("invalidated token", func() {
+			It("should not be valid", func() {
+				s := apns.NewMemoryTokenStore()
+				s.InvalidateToken(tok, time.Now())
+
+				valid, _ := s.TokenValid(tok)
+				Expect(valid).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("#InvalidateToken", func() {
+		Context("token registered after the invalidation", func() {
+			It("should stay valid", func() {
+				s := apns.NewMemoryTokenStore()
+				s.RegisterToken(tok, time.Unix(200, 0))
+
+				Expect(s.InvalidateToken(tok, time.Unix(100, 0))).To(BeNil())
+
+				valid, _ := s.TokenValid(tok)
+				Expect(valid).To(BeTrue())
+			})
+		})
+
+		Context("token registered before the invalidation", func() {
+			It("should become invalid", func() {
+				s := apns.NewMemoryTokenStore()
+				s.RegisterToken(tok, time.Unix(100, 0))
+
+				Expect(s.InvalidateToken(tok, time.Unix(200, 0))).To(BeNil())
+
+				valid, _ := s.TokenValid(tok)
+				Expect(valid).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("#RegisterToken", func() {
+		It("should make an invalidated token valid again", func() {
+			s := apns.NewMemoryTokenStore()
+			s.InvalidateToken(tok, time.Unix(100, 0))
+			Expect(s.RegisterToken(tok, time.Unix(200, 0))).To(BeNil())
+
+			valid, _ := s.TokenValid(tok)
+			Expect(valid).To(BeTrue())
+		})
+	})
+
+	Describe("#LastSuccess", func() {
+		It("should return the last success", func() {
+			s := apns.NewMemoryTokenStore()
+
+			_, ok, err := s.LastSuccess(tok)
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeFalse())
+
+			Expect(s.TokenSucceeded(tok, time.Unix(100, 0))).To(BeNil())
+
+			t, ok, err := s.LastSuccess(tok)
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeTrue())
+			Expect(t).To(Equal(time.Unix(100, 0)))
+		})
+	})
+})
+
+var _ = Describe("SQLTokenStore", func() {
+	tok := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+	var db *fakeDB
+	var s *apns.SQLTokenStore
+
+	BeforeEach(func() {
+		db = newFakeDB()
+		s = apns.NewSQLTokenStore(sql.OpenDB(db), "tokens")
+	})
+
+	AfterEach(func() {
+		s.DB.Close()
+	})
+
+	Describe("#TokenValid", func() {
+		Context("unknown token", func() {
+			It("should be valid", func() {
+				valid, err := s.TokenValid(tok)
+				Expect(err).To(BeNil())
+				Expect(valid).To(BeTrue())
+			})
+		})
+
+		Context("invalidated token", func() {
+			It("should not be valid", func() {
+				Expect(s.InvalidateToken(tok, time.Unix(100, 0))).To(BeNil())
+
+				valid, err := s.TokenValid(tok)
+				Expect(err).To(BeNil())
+				Expect(valid).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("#InvalidateToken", func() {
+		Context("token registered after the invalidation", func() {
+			It("should stay valid", func() {
+				Expect(s.RegisterToken(tok, time.Unix(200, 0))).To(BeNil())
+				Expect(s.InvalidateToken(tok, time.Unix(100, 0))).To(BeNil())
+
+				valid, _ := s.TokenValid(tok)
+				Expect(valid).To(BeTrue())
+			})
+		})
+
+		Context("token inserted by another writer first", func() {
+			It("should update it", func() {
+				db.beforeInsert = func(db *fakeDB) {
+					db.mu.Lock()
+					defer db.mu.Unlock()
+
+					db.insert(tok, fakeRow{lastSuccess: 50})
+				}
+
+				Expect(s.InvalidateToken(tok, time.Unix(100, 0))).To(BeNil())
+
+				valid, _ := s.TokenValid(tok)
+				Expect(valid).To(BeFalse())
+
+				t, ok, _ := s.LastSuccess(tok)
+				Expect(ok).To(BeTrue())
+				Expect(t).To(Equal(time.Unix(50, 0)))
+			})
+		})
+	})
+
+	Describe("#RegisterToken", func() {
+		It("should make an invalidated token valid again", func() {
+			Expect(s.InvalidateToken(tok, time.Unix(100, 0))).To(BeNil())
+			Expect(s.RegisterToken(tok, time.Unix(200, 0))).To(BeNil())
+
+			valid, _ := s.TokenValid(tok)
+			Expect(valid).To(BeTrue())
+		})
+	})
+
+	Describe("#LastSuccess", func() {
+		It("should return the last success", func() {
+			_, ok, err := s.LastSuccess(tok)
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeFalse())
+
+			Expect(s.TokenSucceeded(tok, time.Unix(100, 0))).To(BeNil())
+			Expect(s.TokenSucceeded(tok, time.Unix(150, 0))).To(BeNil())
+
+			t, ok, err := s.LastSuccess(tok)
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeTrue())
+			Expect(t).To(Equal(time.Unix(150, 0)))
+		})
+
+		Context("token without a success", func() {
+			It("should return none", func() {
+				Expect(s.RegisterToken(tok, time.Unix(100, 0))).To(BeNil())
+
+				_, ok, err := s.LastSuccess(tok)
+				Expect(err).To(BeNil())
+				Expect(ok).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("#Placeholder", func() {
+		It("should number the parameters", func() {
+			s.Placeholder = apns.DollarPlaceholder
+
+			Expect(s.InvalidateToken(tok, time.Unix(100, 0))).To(BeNil())
+
+			Expect(db.Queries()).To(Equal([]string{
+				"UPDATE tokens SET invalidated_at = $1 WHERE token = $2 AND registered_at <= $3",
+				"SELECT COUNT(*) FROM tokens WHERE token = $1",
+				"INSERT INTO tokens (token, invalidated_at) VALUES ($1, $2)",
+			}))
+		})
+
+		Context("when it's nil", func() {
+			It("should use ?", func() {
+				Expect(s.TokenSucceeded(tok, time.Unix(100, 0))).To(BeNil())
+
+				Expect(db.Queries()).To(Equal([]string{
+					"UPDATE tokens SET last_success_at = ? WHERE token = ?",
+					"SELECT COUNT(*) FROM tokens WHERE token = ?",
+					"INSERT INTO tokens (token, last_success_at) VALUES (?, ?)",
+				}))
+			})
+		})
+	})
+})
@@ -0,0 +1,59 @@
+package apns
+
+import (
+	"errors"
+	"strings"
+)
+
+// MaxVoIPPayloadSize is the largest JSON payload of a VoIP notification, in
+// bytes
+const MaxVoIPPayloadSize = 5120
+
+var (
+	ErrVoIPPriority = errors.New("VoIP notifications must have priority 10")
+
+	// ErrNotVoIP is returned by Send on a VoIP client for notifications
+	// without PushTypeVoIP
+	ErrNotVoIP = errors.New("VoIP clients only send VoIP notifications")
+
+	// ErrVoIPClientRequired is returned by Send for VoIP notifications on a
+	// client without VoIP set
+	ErrVoIPClientRequired = errors.New("VoIP notifications need a VoIP client")
+)
+
+// NewVoIPNotification creates a PushKit notification for the app bundleID,
+// with PushTypeVoIP, the .voip topic and PriorityImmediate
+func NewVoIPNotification(bundleID string) Notification {
+	n := NewNotification()
+	n.PushType = PushTypeVoIP
+	n.Topic = strings.TrimSuffix(bundleID, ".voip") + ".voip"
+	n.Priority = PriorityImmediate
+
+	return n
+}
+
+// maxPayloadSize is the largest payload APNs accepts for n's push type
+func (n Notification) maxPayloadSize() int {
+	if n.PushType == PushTypeVoIP {
+		return MaxVoIPPayloadSize
+	}
+
+	return MaxPayloadSize
+}
+
+// voipError keeps VoIP notifications and other ones to their own clients,
+// so they go out with the right certificate, and VoIP ones at priority 10
+// whatever the filters did
+func (c *Client) voipError(n Notification) error {
+	switch {
+	case c.VoIP && n.PushType != PushTypeVoIP:
+		return ErrNotVoIP
+	case !c.VoIP && n.PushType == PushTypeVoIP:
+		return ErrVoIPClientRequired
+	case n.PushType == PushTypeVoIP && n.Priority == PriorityPowerConserve:
+		// e.g. downgraded by a DeliveryWindow
+		return ErrVoIPPriority
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package apns_test
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+// downgradeFilter sends every notification with PriorityPowerConserve
+type downgradeFilter struct{}
+
+func (downgradeFilter) FilterSend(n *apns.Notification, now time.Time) (time.Time, error) {
+	n.Priority = apns.PriorityPowerConserve
+	return time.Time{}, nil
+}
+
+var _ = Describe("VoIP", func() {
+	tok := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+	// A payload of exactly size bytes
+	payload := func(size int) *apns.Payload {
+		p := apns.NewPayload()
+		p.SetCustomValue("call", strings.Repeat("x", size-len(`{"aps":{},"call":""}`)))
+		return p
+	}
+
+	Describe("#NewVoIPNotification", func() {
+		It("should set the push type, topic and priority", func() {
+			n := apns.NewVoIPNotification("com.example.app")
+
+			Expect(n.PushType).To(Equal(apns.PushTypeVoIP))
+			Expect(n.Topic).To(Equal("com.example.app.voip"))
+			Expect(n.Priority).To(Equal(apns.PriorityImmediate))
+			Expect(n.Payload).NotTo(BeNil())
+		})
+
+		Context("with the .voip topic", func() {
+			It("should not add the suffix twice", func() {
+				n := apns.NewVoIPNotification("com.example.app.voip")
+
+				Expect(n.Topic).To(Equal("com.example.app.voip"))
+			})
+		})
+	})
+
+	Describe("#Validate", func() {
+		Context("a 5KB VoIP payload", func() {
+			It("should be valid", func() {
+				n := apns.NewVoIPNotification("com.example.app")
+				n.DeviceToken = tok
+				n.Payload = payload(apns.MaxVoIPPayloadSize)
+
+				Expect(n.Validate()).To(BeNil())
+			})
+		})
+
+		Context("a VoIP payload over 5KB", func() {
+			It("should be too large", func() {
+				n := apns.NewVoIPNotification("com.example.app")
+				n.DeviceToken = tok
+				n.Payload = payload(apns.MaxVoIPPayloadSize + 1)
+
+				Expect(n.Validate()).To(MatchError(apns.ErrPayloadTooLarge))
+			})
+		})
+
+		Context("a 5KB alert payload", func() {
+			It("should be too large", func() {
+				n := apns.NewNotification()
+				n.DeviceToken = tok
+				n.Payload = payload(apns.MaxVoIPPayloadSize)
+
+				Expect(n.Validate()).To(MatchError(apns.ErrPayloadTooLarge))
+			})
+		})
+
+		Context("power conserving priority", func() {
+			It("should be invalid", func() {
+				n := apns.NewVoIPNotification("com.example.app")
+				n.DeviceToken = tok
+				n.Priority = apns.PriorityPowerConserve
+
+				Expect(n.Validate()).To(MatchError(apns.ErrVoIPPriority))
+			})
+		})
+
+		Context("topic without .voip", func() {
+			It("should be invalid", func() {
+				n := apns.NewVoIPNotification("com.example.app")
+				n.DeviceToken = tok
+				n.Topic = "com.example.app"
+
+				Expect(n.Validate()).To(MatchError(apns.ErrTopicPushTypeMismatch))
+			})
+		})
+	})
+
+	Describe("Client", func() {
+		Context("VoIP client sending an alert", func() {
+			It("should be rejected", func() {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+				c.VoIP = true
+
+				n := apns.NewNotification()
+				n.DeviceToken = tok
+
+				Expect(c.Send(n)).To(Equal(apns.ErrNotVoIP))
+			})
+		})
+
+		Context("other client sending a VoIP notification", func() {
+			It("should be rejected", func() {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+
+				n := apns.NewVoIPNotification("com.example.app")
+				n.DeviceToken = tok
+
+				Expect(c.Send(n)).To(Equal(apns.ErrVoIPClientRequired))
+			})
+		})
+
+		Context("VoIP notification downgraded by a filter", func() {
+			It("should be rejected", func() {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+				c.VoIP = true
+				c.Filters = []apns.SendFilter{downgradeFilter{}}
+
+				n := apns.NewVoIPNotification("com.example.app")
+				n.DeviceToken = tok
+
+				Expect(c.Send(n)).To(Equal(apns.ErrVoIPPriority))
+			})
+		})
+
+		Context("VoIP client multicasting an alert", func() {
+			It("should be rejected", func() {
+				c, _ := apns.NewClient(apns.ProductionGateway, DummyCert, DummyKey)
+				c.VoIP = true
+
+				_, err := c.Multicast(apns.NewPayload(), []string{tok}, apns.MulticastOptions{})
+
+				Expect(err).To(Equal(apns.ErrNotVoIP))
+			})
+		})
+
+		Context("VoIP client sending a VoIP notification", func() {
+			n := apns.NewVoIPNotification("com.example.app")
+			n.DeviceToken = tok
+			n.Identifier = 1
+			n.Payload = payload(4000)
+
+			nb, _ := n.ToBinary()
+
+			It("should send it", func(d Done) {
+				mockDone := make(chan interface{})
+
+				as := [][]serverAction{
+					[]serverAction{
+						serverAction{action: readAction, data: []byte{}},
+						// TLS may split the frame, so only check its command
+						// and length
+						serverAction{action: readAction, data: make([]byte, len(nb)), cb: func(a serverAction) {
+							Expect(a.data[:5]).To(Equal(nb[:5]))
+
+							close(mockDone)
+							close(d)
+						}},
+					},
+				}
+
+				withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+					c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+					c.Conn.Conf.InsecureSkipVerify = true
+					c.VoIP = true
+
+					Expect(c.Send(n)).To(BeNil())
+				})
+			})
+		})
+	})
+})
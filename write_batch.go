@@ -0,0 +1,126 @@
+package apns
+
+import (
+	"bufio"
+	"container/list"
+	"io"
+	"time"
+)
+
+const (
+	// DefaultFlushInterval is how long batched notifications wait to be
+	// written when FlushInterval is 0
+	DefaultFlushInterval = 10 * time.Millisecond
+
+	// A batch is flushed once it has this many notifications, so it never
+	// gets pushed out of the 50 notification resend buffer
+	maxBatchFrames = 25
+)
+
+// frameWriter writes notification frames to the connection, batching them
+// into larger writes when the client has a WriteBufferSize. It remembers the
+// first notification that hasn't been flushed, so it and the ones after it
+// can be resent when a write fails.
+type frameWriter struct {
+	conn io.Writer
+	bw   *bufio.Writer
+
+	interval time.Duration
+	timer    *time.Timer
+	armed    bool
+
+	unflushed *list.Element
+	frames    int
+}
+
+func (c *Client) newFrameWriter() *frameWriter {
+	w := &frameWriter{conn: c.Conn}
+	if c.WriteBufferSize <= 0 {
+		return w
+	}
+
+	w.bw = bufio.NewWriterSize(c.Conn, c.WriteBufferSize)
+
+	if w.interval = c.FlushInterval; w.interval == 0 {
+		w.interval = DefaultFlushInterval
+	}
+
+	w.timer = time.NewTimer(w.interval)
+	w.timer.Stop()
+
+	return w
+}
+
+// flushC fires when the batch is due to be flushed. It's nil when not
+// batching.
+func (w *frameWriter) flushC() <-chan time.Time {
+	if w.timer == nil {
+		return nil
+	}
+
+	return w.timer.C
+}
+
+// write writes the frame b of the notification in e, and flushes it right
+// away if flush is set
+func (w *frameWriter) write(e *list.Element, b []byte, flush bool) error {
+	if w.bw == nil {
+		_, err := w.conn.Write(b)
+		return err
+	}
+
+	// Flush first rather than let bufio split b, so every notification
+	// before unflushed is known to be written
+	if w.bw.Buffered() > 0 && w.bw.Available() < len(b) {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+
+	if w.unflushed == nil {
+		w.unflushed = e
+	}
+
+	if _, err := w.bw.Write(b); err != nil {
+		return err
+	}
+	w.frames++
+
+	if flush || w.frames >= maxBatchFrames {
+		return w.flush()
+	}
+
+	// b was bigger than the buffer, and bufio wrote it directly
+	if w.bw.Buffered() == 0 {
+		w.unflushed = nil
+		w.frames = 0
+		return nil
+	}
+
+	if !w.armed {
+		w.timer.Reset(w.interval)
+		w.armed = true
+	}
+
+	return nil
+}
+
+func (w *frameWriter) flush() error {
+	if w.bw == nil {
+		return nil
+	}
+
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+
+	w.unflushed = nil
+	w.frames = 0
+	return nil
+}
+
+func (w *frameWriter) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
@@ -0,0 +1,146 @@
+package apns_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/timehop/apns"
+)
+
+var _ = Describe("Write batching", func() {
+	tok := "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535"
+
+	n1 := apns.Notification{Identifier: 1, DeviceToken: tok}
+	n2 := apns.Notification{Identifier: 2, DeviceToken: tok}
+	n3 := apns.Notification{Identifier: 3, DeviceToken: tok}
+
+	n1b, _ := n1.ToBinary()
+	n2b, _ := n2.ToBinary()
+	n3b, _ := n3.ToBinary()
+
+	all := append(append(append([]byte{}, n1b...), n2b...), n3b...)
+
+	Context("several notifications", func() {
+		It("should write them together", func(d Done) {
+			mockDone := make(chan interface{})
+
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}},
+					serverAction{action: readAction, data: make([]byte, len(all)), cb: func(a serverAction) {
+						Expect(a.data).To(Equal(all))
+
+						close(mockDone)
+						close(d)
+					}},
+				},
+			}
+
+			withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+				c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+				c.Conn.Conf.InsecureSkipVerify = true
+				c.WriteBufferSize = 4096
+				c.FlushInterval = 50 * time.Millisecond
+
+				Expect(c.Send(n1)).To(BeNil())
+				Expect(c.Send(n2)).To(BeNil())
+				Expect(c.Send(n3)).To(BeNil())
+			})
+		})
+	})
+
+	Context("good, bad, good in one batch", func() {
+		It("should resend the last good one", func(d Done) {
+			mockDone := make(chan interface{})
+
+			errPayload := bytes.NewBuffer([]byte{})
+			binary.Write(errPayload, binary.BigEndian, uint8(8))
+			binary.Write(errPayload, binary.BigEndian, uint8(8))
+			binary.Write(errPayload, binary.BigEndian, uint32(2))
+
+			as := [][]serverAction{
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}},
+					serverAction{action: readAction, data: make([]byte, len(all))},
+					serverAction{action: writeAction, data: errPayload.Bytes()},
+					serverAction{action: closeAction},
+				},
+				[]serverAction{
+					serverAction{action: readAction, data: []byte{}},
+					serverAction{action: readAction, data: make([]byte, len(n3b)), cb: func(a serverAction) {
+						Expect(a.data).To(Equal(n3b))
+
+						close(mockDone)
+						close(d)
+					}},
+				},
+			}
+
+			withMockServerAsync(as, mockDone, func(s *mockTLSServer) {
+				c, _ := apns.NewClient(s.Address(), DummyCert, DummyKey)
+				c.Conn.Conf.InsecureSkipVerify = true
+				c.WriteBufferSize = 4096
+
+				Expect(c.Send(n1)).To(BeNil())
+				Expect(c.Send(n2)).To(BeNil())
+				Expect(c.Send(n3)).To(BeNil())
+			})
+		})
+	})
+})
+
+// benchmarkSend measures sending b.N notifications to a local TLS server,
+// until the server has read them all
+func benchmarkSend(b *testing.B, bufferSize int) {
+	cert, _ := tls.X509KeyPair([]byte(DummyCert), []byte(DummyKey))
+	l, err := tls.Listen("tcp", "localhost:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	n := apns.Notification{DeviceToken: "00a18269661e9406aea59a5620b05c7c0e371574fa6f251951de8d7a5a292535", Payload: apns.NewPayload()}
+	n.Payload.APS.Alert.Body = "Hello"
+	frame, _ := n.ToBinary()
+
+	received := make(chan int64)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		read, _ := io.CopyN(io.Discard, c, int64(len(frame)*b.N))
+		received <- read
+	}()
+
+	c, _ := apns.NewClient(l.Addr().String(), DummyCert, DummyKey)
+	c.Conn.Conf.InsecureSkipVerify = true
+	c.WriteBufferSize = bufferSize
+
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c.Send(n)
+	}
+
+	if read := <-received; read != int64(len(frame)*b.N) {
+		b.Fatalf("server read %d bytes", read)
+	}
+}
+
+func BenchmarkSendUnbatched(b *testing.B) {
+	benchmarkSend(b, 0)
+}
+
+func BenchmarkSendBatched(b *testing.B) {
+	benchmarkSend(b, 16*1024)
+}